@@ -0,0 +1,212 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProxyBodyTransform 对指定Content-Type的响应体进行字符串或正则替换
+type ProxyBodyTransform struct {
+	contentTypes  []string
+	substitutions []*ProxyBodySubstitution
+}
+
+type ProxyBodySubstitution struct {
+	from    []byte
+	to      *VariableExpr
+	re      *regexp.Regexp
+	replace []byte
+}
+
+func NewProxyBodyTransform(body *BodyTransform) *ProxyBodyTransform {
+	ret := &ProxyBodyTransform{
+		contentTypes:  body.ContentTypes,
+		substitutions: []*ProxyBodySubstitution{},
+	}
+	if len(ret.contentTypes) == 0 {
+		ret.contentTypes = []string{"text/html"}
+		debug("set body transform content types default text/html")
+	}
+	for _, sub := range body.Substitutions {
+		if sub == nil {
+			continue
+		}
+		if sub.Pattern != "" {
+			ret.substitutions = append(ret.substitutions, &ProxyBodySubstitution{
+				re:      regexp.MustCompile(sub.Pattern),
+				replace: []byte(sub.Replace),
+			})
+		} else {
+			ret.substitutions = append(ret.substitutions, &ProxyBodySubstitution{
+				from: []byte(sub.From),
+				to:   NewVariableExpr(sub.To),
+			})
+		}
+	}
+	return ret
+}
+
+// matchContentType 比较时忽略参数部分，支持`text/*`形式的通配符
+func (this *ProxyBodyTransform) matchContentType(contentType string) bool {
+	return matchMediaType(this.contentTypes, contentType)
+}
+
+func (this *ProxyBodyTransform) apply(body []byte, variables *ProxyVariable) []byte {
+	for _, sub := range this.substitutions {
+		if sub.re != nil {
+			body = sub.re.ReplaceAll(body, sub.replace)
+		} else {
+			body = bytes.Replace(body, sub.from, []byte(sub.to.Load(variables)), -1)
+		}
+	}
+	return body
+}
+
+// transformResponseBody 修改响应体，206分段响应不做修改
+func (this *ProxyHandle) transformResponseBody(resp *http.Response, c *Context, apply func([]byte) ([]byte, bool)) {
+	if resp.StatusCode == http.StatusPartialContent {
+		return
+	}
+	body, length, changed := this.transformBody(resp.Header, resp.Body, resp.ContentLength, c, apply)
+	resp.Body = body
+	if changed {
+		resp.ContentLength = length
+		resp.TransferEncoding = nil
+		weakenETag(resp.Header)
+	}
+}
+
+// transformRequestBody 修改发送给目标地址的请求体
+func (this *ProxyHandle) transformRequestBody(req *http.Request, c *Context, apply func([]byte) ([]byte, bool)) {
+	body, length, changed := this.transformBody(req.Header, req.Body, req.ContentLength, c, apply)
+	req.Body = body
+	if changed {
+		req.ContentLength = length
+		req.TransferEncoding = nil
+	}
+}
+
+// transformBody 读取并解压body，修改后重新压缩并计算Content-Length
+// body超过maxBodySize或编码不支持时，body保持不变
+func (this *ProxyHandle) transformBody(header http.Header, body io.ReadCloser, contentLength int64, c *Context, apply func([]byte) ([]byte, bool)) (io.ReadCloser, int64, bool) {
+	if body == nil || body == http.NoBody {
+		return body, contentLength, false
+	}
+	encoding := header.Get("Content-Encoding")
+	if !supportedEncoding(encoding) {
+		debug("skip body transform for content encoding", encoding)
+		return body, contentLength, false
+	}
+	if contentLength > this.maxBodySize {
+		debug("skip body transform for large body", contentLength)
+		return body, contentLength, false
+	}
+	raw, body, ok, err := bufferBody(body, this.maxBodySize)
+	if err != nil {
+		c.variables.Set("error_message", fmt.Sprintf("read body failed %v", err))
+		this.errorLog.Logfmt(c.variables)
+		return body, contentLength, false
+	}
+	if !ok {
+		debug("skip body transform for large body")
+		return body, contentLength, false
+	}
+	decoded, ok := decodeBody(encoding, raw, this.maxBodySize)
+	if !ok {
+		debug("skip body transform for undecodable body")
+		return body, contentLength, false
+	}
+	decoded, changed := apply(decoded)
+	if !changed {
+		return body, contentLength, false
+	}
+	raw = encodeBody(encoding, decoded)
+	header.Set("Content-Length", strconv.Itoa(len(raw)))
+	return ioutil.NopCloser(bytes.NewReader(raw)), int64(len(raw)), true
+}
+
+// bufferBody 读取最多limit字节的body，返回读取到的内容和可以重新读取完整body的ReadCloser
+// body超过limit时返回false
+func bufferBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, bool, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	restored := &readCloser{
+		Reader: io.MultiReader(bytes.NewReader(buf), body),
+		Closer: body,
+	}
+	if err != nil {
+		return nil, restored, false, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, restored, false, nil
+	}
+	return buf, restored, true, nil
+}
+
+func supportedEncoding(encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return encoding == "" || encoding == "identity" || encoding == "gzip"
+}
+
+// decodeBody 按照Content-Encoding解压，解压后超过limit时返回false
+func decodeBody(encoding string, raw []byte, limit int64) ([]byte, bool) {
+	if strings.ToLower(strings.TrimSpace(encoding)) != "gzip" {
+		return raw, true
+	}
+	r, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	ret, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil || int64(len(ret)) > limit {
+		return nil, false
+	}
+	return ret, true
+}
+
+func encodeBody(encoding string, body []byte) []byte {
+	if strings.ToLower(strings.TrimSpace(encoding)) != "gzip" {
+		return body
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+// weakenETag 修改响应体后，强ETag不再准确，改为弱ETag
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// matchMediaType 判断Content-Type是否在列表中，支持`text/*`形式的通配符
+func matchMediaType(mediaTypes []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range mediaTypes {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) || t == "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// readCloser 组合Reader和Closer，用于还原已经读取了一部分的body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
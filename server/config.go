@@ -39,39 +39,217 @@ type App struct {
 	AccessLog *Log       `json:"access_log,omitempty" valid:"optional,message_type=$name必须是log数组"`
 	ErrorLog  *Log       `json:"error_log,omitempty" valid:"optional,message_type=$name必须是log数组"`
 	Logfmts   []*Logfmt  `json:"logfmts,omitempty" valid:"optional,message_type=$name必须是logfmt数组"`
+	Default   bool       `json:"default,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+
+	TrustedProxies []string `json:"trusted_proxies,omitempty" valid:"optional,@cidr,message=$name($value)不是合法的ip或CIDR"`
+	RealIp         string   `json:"real_ip,omitempty" valid:"optional,{x_forwarded_for,x_real_ip,proxy_protocol},message=$name只能是x_forwarded_for、x_real_ip或proxy_protocol"`
 }
 
 type Domain struct {
-	Domain string  `json:"domain,omitempty" valid:"/^[a-z0-9-_\\.]+$/,message_required=$name是必选项,message=$name($value)是非法域名"`
-	Rules  []*Rule `json:"rules,omitempty" valid:"message_required=$name是必选项,message_type=$name必须是rule数组"`
+	Domain  string  `json:"domain,omitempty" valid:"@domain,message_required=$name是必选项,message=$name($value)是非法域名"`
+	Rules   []*Rule `json:"rules,omitempty" valid:"message_required=$name是必选项,message_type=$name必须是rule数组"`
+	Default bool    `json:"default,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+	Cors    *Cors   `json:"cors,omitempty" valid:"optional,message_type=$name非法的cors对象"`
 }
 
 type Rule struct {
+	Name      string     `json:"name,omitempty" valid:"optional,/^[A-Za-z0-9_\\-\\.]+$/,message=$name($value)不合法"`
+	Priority  int        `json:"priority,omitempty" valid:"optional,message=$name($value)必须是整数"`
 	Filters   []*Filter  `json:"filters,omitempty" valid:"optional,message_type=$name非法的filter对象"`
-	To        string     `json:"to,omitempty" valid:"[1,],message=$name($value)不合法"`
+	Match     string     `json:"match,omitempty" valid:"optional,message=$name($value)不合法"`
+	To        RuleTo     `json:"to,omitempty" valid:"optional,message_type=$name必须是字符串或target数组"`
+	Sticky    string     `json:"sticky,omitempty" valid:"optional,@variable,message=$name($value)不合法"`
 	Transform *Transform `json:"transform,omitempty" valid:"optional,message_type=$name($value)非法的transform对象"`
+	Mirror    *Mirror    `json:"mirror,omitempty" valid:"optional,message_type=$name非法的mirror对象"`
+	Return    *Return    `json:"return,omitempty" valid:"optional,message_type=$name非法的return对象"`
+	Static    *Static    `json:"static,omitempty" valid:"optional,message_type=$name非法的static对象"`
+	Rewrite   *Rewrite   `json:"rewrite,omitempty" valid:"optional,message_type=$name非法的rewrite对象"`
+	Cors      *Cors      `json:"cors,omitempty" valid:"optional,message_type=$name非法的cors对象"`
+
+	PreserveHost bool `json:"preserve_host,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+}
+
+// Cors 跨域访问策略，由代理直接响应预检请求
+type Cors struct {
+	AllowOrigins     []string `json:"allow_origins,omitempty" valid:"@origin,message=$name($value)不是合法的Origin"`
+	AllowMethods     []string `json:"allow_methods,omitempty" valid:"optional,/^[A-Z]+$/,message=$name($value)不是合法的Http Method"`
+	AllowHeaders     []string `json:"allow_headers,omitempty" valid:"optional,/^[A-Za-z0-9_\\-]+$/,message=$name非法的Http Header Key"`
+	ExposeHeaders    []string `json:"expose_headers,omitempty" valid:"optional,/^[A-Za-z0-9_\\-]+$/,message=$name非法的Http Header Key"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+	MaxAge           int      `json:"max_age,omitempty" valid:"optional,[0,],message=$name($value)不能是负数"`
+}
+
+type Rewrite struct {
+	StripPrefix string          `json:"strip_prefix,omitempty" valid:"optional,/^\\//,message=$name($value)必须以斜杠开头"`
+	AddPrefix   string          `json:"add_prefix,omitempty" valid:"optional,/^\\//,message=$name($value)必须以斜杠开头"`
+	Regex       []*RegexRewrite `json:"regex,omitempty" valid:"optional,message_type=$name非法的regex_rewrite对象"`
+	Query       []*QueryRewrite `json:"query,omitempty" valid:"optional,message_type=$name非法的query_rewrite对象"`
+}
+
+type RegexRewrite struct {
+	Pattern string `json:"pattern,omitempty" valid:"@regexp,message=$name($value)不是合法的正则表达式"`
+	Replace string `json:"replace,omitempty" valid:"optional,message=$name($value)不合法"`
+}
+
+type QueryRewrite struct {
+	Method string `json:"method,omitempty" valid:"{set,add,del,rename},message=$name($value)不合法"`
+	Key    string `json:"key,omitempty" valid:"[1,],message=$name非法的请求参数名"`
+	Value  string `json:"value,omitempty" valid:"optional,@variable,message=$name非法的请求参数值"`
+	To     string `json:"to,omitempty" valid:"optional,message=$name非法的请求参数名"`
+}
+
+type Static struct {
+	Index     []string `json:"index,omitempty" valid:"optional,message=$name必须是字符串数组"`
+	Autoindex bool     `json:"autoindex,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+	TryFiles  []string `json:"try_files,omitempty" valid:"optional,@variable,message=$name必须是字符串数组"`
+}
+
+type Return struct {
+	Status   int               `json:"status,omitempty" valid:"[100,599],message=$name($value)不是合法的Http Status"`
+	Location string            `json:"location,omitempty" valid:"optional,@variable,message=$name($value)不合法"`
+	Headers  map[string]string `json:"headers,omitempty" valid:"optional,message_type=$name必须是字符串键值对"`
+	Body     string            `json:"body,omitempty" valid:"optional,@variable,message=$name不合法"`
+}
+
+type Mirror struct {
+	To          string `json:"to,omitempty" valid:"[1,],@variable,message=$name($value)不合法"`
+	Sample      int    `json:"sample,omitempty" valid:"optional,[1,100],message=$name($value)请填写1-100的整数"`
+	MaxBodySize int64  `json:"max_body_size,omitempty" valid:"optional,(0,),message=$name($value)必须是正整数"`
+	Timeout     int    `json:"timeout,omitempty" valid:"optional,[1,3600],message=$name($value)不合法"`
+	Concurrency int    `json:"concurrency,omitempty" valid:"optional,[1,],message=$name($value)必须是正整数"`
+	ErrorLog    *Log   `json:"error_log,omitempty" valid:"optional,message_type=$name非法的log对象"`
+}
+
+// RuleTo 代理目标，可以是一个地址字符串，也可以是带权重的target数组
+type RuleTo []*Target
+
+type Target struct {
+	To     string `json:"to,omitempty" valid:"[1,],@variable,message=$name($value)不合法"`
+	Weight int    `json:"weight,omitempty" valid:"optional,[1,],message=$name($value)必须是正整数"`
+}
+
+func (this *RuleTo) UnmarshalJSON(raw []byte) error {
+	var targets []*Target
+	if err := json.Unmarshal(this.normalizeRaw(raw), &targets); err != nil {
+		return err
+	}
+	*this = targets
+	return nil
+}
+
+func (this RuleTo) MarshalJSON() ([]byte, error) {
+	if len(this) == 1 && this[0] != nil && this[0].Weight == 0 {
+		return json.Marshal(this[0].To)
+	}
+	return json.Marshal([]*Target(this))
+}
+
+// normalizeRaw 将字符串形式的to转换为target数组
+func (this RuleTo) normalizeRaw(raw []byte) []byte {
+	var to string
+	if err := json.Unmarshal(raw, &to); err != nil {
+		return raw
+	}
+	ret, _ := json.Marshal([]*Target{{To: to}})
+	return ret
 }
 
 type Filter struct {
-	RequestURIs []string        `json:"request_uris,omitempty" valid:"optional,message=$name($value)不合法"`
+	Prefix      string          `json:"prefix,omitempty" valid:"optional,/^\\//,message=$name($value)必须以斜杠开头"`
+	ExactPath   string          `json:"exact_path,omitempty" valid:"optional,/^\\//,message=$name($value)必须以斜杠开头"`
+	RequestURIs []string        `json:"request_uris,omitempty" valid:"optional,@capture,message=$name($value)不是合法的正则表达式或命名分组与内置变量重名"`
+	Methods     []string        `json:"methods,omitempty" valid:"optional,/^[A-Za-z]+$/,message=$name($value)不是合法的Http Method"`
 	Headers     []*HeaderFilter `json:"headers,omitempty" valid:"optional,message=$name非法的header_filter对象"`
+	Queries     []*QueryFilter  `json:"queries,omitempty" valid:"optional,message=$name非法的query_filter对象"`
+	Cookies     []*CookieFilter `json:"cookies,omitempty" valid:"optional,message=$name非法的cookie_filter对象"`
+	RemoteAddrs []string        `json:"remote_addrs,omitempty" valid:"optional,@cidr,message=$name($value)不是合法的ip或CIDR"`
 }
 
 type HeaderFilter struct {
-	Key   string `json:"key,omitempty" valid:"/[A-Za-z0-9_\\-]+/,message=$name非法的Http Header Key"`
-	Value string `json:"value,omitempty" valid:"message=$name非法的Http Header Value"`
+	Key        string `json:"key,omitempty" valid:"/[A-Za-z0-9_\\-]+/,message=$name非法的Http Header Key"`
+	Op         string `json:"op,omitempty" valid:"optional,{equals,regex,prefix,exists,not_exists,not_equals},message=$name($value)不合法"`
+	Value      string `json:"value,omitempty" valid:"optional,@variable,message=$name非法的Http Header Value"`
+	IgnoreCase bool   `json:"ignore_case,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+}
+
+type QueryFilter struct {
+	Key   string `json:"key,omitempty" valid:"[1,],message=$name非法的请求参数名"`
+	Value string `json:"value,omitempty" valid:"optional,@variable,message=$name非法的请求参数值"`
+}
+
+type CookieFilter struct {
+	Key   string `json:"key,omitempty" valid:"/^[A-Za-z0-9_\\-\\.]+$/,message=$name非法的Cookie名"`
+	Value string `json:"value,omitempty" valid:"optional,@variable,message=$name非法的Cookie值"`
 }
 
 type Transform struct {
-	Headers []*HeaderTransform `json:"headers,omitempty" valid:"optional,message_type=$name非法的header_transform对象"`
+	Headers     []*HeaderTransform `json:"headers,omitempty" valid:"optional,message_type=$name非法的header_transform对象"`
+	Queries     []*QueryTransform  `json:"queries,omitempty" valid:"optional,message_type=$name非法的query_transform对象"`
+	Cookies     []*CookieTransform `json:"cookies,omitempty" valid:"optional,message_type=$name非法的cookie_transform对象"`
+	Body        *BodyTransform     `json:"body,omitempty" valid:"optional,message_type=$name非法的body_transform对象"`
+	Json        []*JsonTransform   `json:"json,omitempty" valid:"optional,message_type=$name非法的json_transform对象"`
+	MaxBodySize int64              `json:"max_body_size,omitempty" valid:"optional,(0,),message=$name($value)必须是正整数"`
+}
+
+type BodyTransform struct {
+	ContentTypes  []string            `json:"content_types,omitempty" valid:"optional,/^[A-Za-z0-9_\\-\\.\\+\\*]+\\/[A-Za-z0-9_\\-\\.\\+\\*]+$/,message=$name($value)不是合法的Content-Type"`
+	Substitutions []*BodySubstitution `json:"substitutions,omitempty" valid:"message_required=$name是必选项,message_type=$name非法的substitution对象"`
+}
+
+type JsonTransform struct {
+	When      string              `json:"when,omitempty" valid:"{request,response},message=$name($value)不合法"`
+	Method    string              `json:"method,omitempty" valid:"{set,del,rename},message=$name($value)不合法"`
+	Pointer   string              `json:"pointer,omitempty" valid:"/^\\//,message=$name($value)必须是以斜杠开头的JSON Pointer"`
+	Value     string              `json:"value,omitempty" valid:"optional,@variable,message=$name($value)不合法"`
+	Type      string              `json:"type,omitempty" valid:"optional,{string,json},message=$name($value)不合法"`
+	To        string              `json:"to,omitempty" valid:"optional,/^\\//,message=$name($value)必须是以斜杠开头的JSON Pointer"`
+	Condition *TransformCondition `json:"condition,omitempty" valid:"optional,message_type=$name非法的condition对象"`
+}
+
+type BodySubstitution struct {
+	From    string `json:"from,omitempty" valid:"optional,message=$name($value)不合法"`
+	To      string `json:"to,omitempty" valid:"optional,@variable,message=$name($value)不合法"`
+	Pattern string `json:"pattern,omitempty" valid:"optional,@regexp,message=$name($value)不是合法的正则表达式"`
+	Replace string `json:"replace,omitempty" valid:"optional,message=$name($value)不合法"`
 }
 
 type HeaderTransform struct {
-	When    string `json:"when,omitempty" valid:"{request,response},message=$name($value)不合法"`
-	Method  string `json:"method,omitempty" valid:"{add,set,get},message=$name($value)不合法"`
-	Key     string `json:"key,omitempty" valid:"/[A-Za-z0-9_\\-]+/,message=$name非法的Http Header Key"`
-	Value   string `json:"value,omitempty" vaild:"optional,message=$name非法的Http Header Value"`
-	Pattern string `json:"pattern,omitempty" vaild:"optional,message=$name非法的pattern"`
+	When      string              `json:"when,omitempty" valid:"{request,response},message=$name($value)不合法"`
+	Method    string              `json:"method,omitempty" valid:"{add,set,del},message=$name($value)不合法"`
+	Key       string              `json:"key,omitempty" valid:"/[A-Za-z0-9_\\-]+/,message=$name非法的Http Header Key"`
+	Value     string              `json:"value,omitempty" valid:"optional,@variable,message=$name非法的Http Header Value"`
+	Pattern   string              `json:"pattern,omitempty" valid:"optional,@capture,message=$name($value)不是合法的正则表达式或命名分组与内置变量重名"`
+	Condition *TransformCondition `json:"condition,omitempty" valid:"optional,message_type=$name非法的condition对象"`
+}
+
+// TransformCondition transform的执行条件，配置的条件都满足时才执行
+type TransformCondition struct {
+	Status       []string `json:"status,omitempty" valid:"optional,@status,message=$name($value)不是合法的Http Status或范围"`
+	ContentTypes []string `json:"content_types,omitempty" valid:"optional,/^[A-Za-z0-9_\\-\\.\\+\\*]+\\/[A-Za-z0-9_\\-\\.\\+\\*]+$/,message=$name($value)不是合法的Content-Type"`
+	Match        string   `json:"match,omitempty" valid:"optional,@expression,message=$name($value)不是合法的表达式"`
+}
+
+type QueryTransform struct {
+	When      string              `json:"when,omitempty" valid:"{request},message=$name($value)不合法"`
+	Method    string              `json:"method,omitempty" valid:"{add,set,del},message=$name($value)不合法"`
+	Key       string              `json:"key,omitempty" valid:"[1,],message=$name非法的请求参数名"`
+	Value     string              `json:"value,omitempty" valid:"optional,@variable,message=$name非法的请求参数值"`
+	Pattern   string              `json:"pattern,omitempty" valid:"optional,@capture,message=$name($value)不是合法的正则表达式或命名分组与内置变量重名"`
+	Condition *TransformCondition `json:"condition,omitempty" valid:"optional,message_type=$name非法的condition对象"`
+}
+
+type CookieTransform struct {
+	When      string              `json:"when,omitempty" valid:"{request,response},message=$name($value)不合法"`
+	Method    string              `json:"method,omitempty" valid:"{add,set,del},message=$name($value)不合法"`
+	Key       string              `json:"key,omitempty" valid:"/^[A-Za-z0-9_\\-\\.]+$/,message=$name非法的Cookie名"`
+	Value     string              `json:"value,omitempty" valid:"optional,@variable,message=$name非法的Cookie值"`
+	Pattern   string              `json:"pattern,omitempty" valid:"optional,@capture,message=$name($value)不是合法的正则表达式或命名分组与内置变量重名"`
+	Domain    string              `json:"domain,omitempty" valid:"optional,@variable,message=$name($value)不合法"`
+	Path      string              `json:"path,omitempty" valid:"optional,@variable,message=$name($value)不合法"`
+	SameSite  string              `json:"same_site,omitempty" valid:"optional,{lax,strict,none},message=$name($value)不合法"`
+	Secure    *bool               `json:"secure,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+	HttpOnly  *bool               `json:"http_only,omitempty" valid:"optional,message_type=$name必须是bool类型"`
+	Condition *TransformCondition `json:"condition,omitempty" valid:"optional,message_type=$name非法的condition对象"`
 }
 
 type Service struct {
@@ -101,13 +279,13 @@ type Check struct {
 
 type Logfmt struct {
 	Name  string   `json:"name,omitempty" valid:"/[a-z0-9_]+/,message=$name不合法"`
-	Lines []string `json:"lines,omitempty" valid:"message=$name必须是字符串数组"`
+	Lines []string `json:"lines,omitempty" valid:"@variable,message=$name($value)不是合法的字符串或变量表达式"`
 }
 
 type Log struct {
 	File         string `json:"file,omitempty" valid:"message=$name($value)不合法"`
 	Fmt          string `json:"fmt,omitempty" valid:"optional,message=$name($value)不合法"`
-	RotateTime   string `json:"rotate_time,omitempty" valid:"optional,{hour|day},message=$name($value)不合法"`
+	RotateTime   string `json:"rotate_time,omitempty" valid:"optional,{hour,day},message=$name($value)不合法"`
 	RotateSize   int64  `json:"rotate_size,omitempty" valid:"optional,(0,),message=$name($value)必须是正整数"`
 	RotateNumber int    `json:"rotate_number,omitempty" valid:"optional,(0,),message=$name($value)必须是正整数"`
 }
@@ -135,6 +313,109 @@ func (this *Config) Load(filename string) error {
 		fmt.Println(string(this.raw))
 		return err
 	}
+	return this.check()
+}
+
+// check 检查字段之间相互依赖、无法通过valid标签描述的配置
+func (this *Config) check() error {
+	for i, app := range this.Apps {
+		if app == nil {
+			continue
+		}
+		for j, domain := range app.Domains {
+			if domain == nil {
+				continue
+			}
+			if domain.Cors != nil {
+				name := fmt.Sprintf("config.apps.apps_%d.domains.domains_%d.cors", i, j)
+				if err := domain.Cors.check(name); err != nil {
+					return err
+				}
+			}
+			for k, rule := range domain.Rules {
+				if rule == nil {
+					continue
+				}
+				name := fmt.Sprintf("config.apps.apps_%d.domains.domains_%d.rules.rules_%d", i, j, k)
+				if err := rule.check(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// check 允许携带凭证时不能允许任意来源，否则任何网站都可以携带用户的凭证访问
+func (this *Cors) check(name string) error {
+	if !this.AllowCredentials {
+		return nil
+	}
+	for _, origin := range this.AllowOrigins {
+		if origin == "*" {
+			return fmt.Errorf("%s.allow_origins：allow_credentials为true时不能使用*", name)
+		}
+	}
+	return nil
+}
+
+func (this *Rule) check(name string) error {
+	if len(this.To) == 0 && this.Return == nil {
+		return fmt.Errorf("%s.to：to和return至少需要配置一个", name)
+	}
+	for i, target := range this.To {
+		if target == nil {
+			return fmt.Errorf("%s.to.to_%d：target不能为空", name, i)
+		}
+	}
+	if this.Cors != nil {
+		if err := this.Cors.check(name + ".cors"); err != nil {
+			return err
+		}
+	}
+	if this.Match != "" {
+		if _, err := NewMatchExpr(this.Match); err != nil {
+			return fmt.Errorf("%s.match(\"%s\")不是合法的表达式：%v", name, this.Match, err)
+		}
+	}
+	for i, filter := range this.Filters {
+		if filter == nil {
+			continue
+		}
+		for j, header := range filter.Headers {
+			if header == nil {
+				continue
+			}
+			if header.Op == "regex" {
+				if re, err := regexp.Compile(header.Value); err != nil {
+					return fmt.Errorf("%s.filters.filters_%d.headers.headers_%d.value(\"%s\")不是合法的正则表达式", name, i, j, header.Value)
+				} else if group := reservedCaptureName(re); group != "" {
+					return fmt.Errorf("%s.filters.filters_%d.headers.headers_%d.value(\"%s\")的命名分组%s与内置变量重名", name, i, j, header.Value, group)
+				}
+			}
+		}
+	}
+	if this.Transform != nil && this.Transform.Body != nil {
+		for i, sub := range this.Transform.Body.Substitutions {
+			if sub == nil {
+				continue
+			}
+			if (sub.From == "") == (sub.Pattern == "") {
+				return fmt.Errorf("%s.transform.body.substitutions.substitutions_%d：from和pattern必须且只能配置一个", name, i)
+			}
+		}
+	}
+	if this.Transform != nil {
+		for i, jsonTransform := range this.Transform.Json {
+			if jsonTransform != nil && jsonTransform.Method == "rename" && jsonTransform.To == "" {
+				return fmt.Errorf("%s.transform.json.json_%d.to：method为rename时to是必选项", name, i)
+			}
+			if jsonTransform != nil && jsonTransform.Method == "rename" &&
+				jsonPointerOverlap(parseJsonPointer(jsonTransform.Pointer), parseJsonPointer(jsonTransform.To)) {
+				return fmt.Errorf("%s.transform.json.json_%d.to：to和pointer不能相同或互相包含", name, i)
+			}
+		}
+	}
 	return nil
 }
 
@@ -1,19 +1,35 @@
 package service
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
 type Context struct {
 	req  *http.Request
 	resp *http.Response
-	w    http.ResponseWriter
+	w    *responseWriter
 	url  string
 
-	startAt   time.Time
-	endAt     time.Time
-	variables *ProxyVariable
+	target *ProxyTarget
+
+	peerIp       string
+	remoteIp     string
+	trusted      bool
+	forwardedFor string
+	domain       *ProxyDomain
+
+	startAt         time.Time
+	upstreamStartAt time.Time
+	endAt           time.Time
+	bytesReceived   int64
+	variables       *ProxyVariable
 }
 
 func NewContext(w http.ResponseWriter, req *http.Request) *Context {
@@ -21,7 +37,75 @@ func NewContext(w http.ResponseWriter, req *http.Request) *Context {
 	// 需要实验验证意义有多大
 	return &Context{
 		req:       req,
-		w:         w,
+		w:         &responseWriter{ResponseWriter: w},
 		variables: NewProxyVariable(),
 	}
 }
+
+// end 记录请求结束时间和耗时
+func (this *Context) end() {
+	this.endAt = time.Now()
+	this.variables.Set("request_end", this.endAt.Format("2006/01/02 15:04:05"))
+	this.variables.Set("latency", fmt.Sprintf("%d", this.endAt.Sub(this.startAt).Nanoseconds()/int64(time.Millisecond)))
+	this.variables.Set("bytes_received", fmt.Sprintf("%d", atomic.LoadInt64(&this.bytesReceived)))
+	this.variables.Set("bytes_sent", fmt.Sprintf("%d", this.w.bytes))
+}
+
+// countBody 统计读取的请求体字节数
+func (this *Context) countBody() {
+	if this.req.Body == nil || this.req.Body == http.NoBody {
+		return
+	}
+	this.req.Body = &countingBody{ReadCloser: this.req.Body, n: &this.bytesReceived}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (this *countingBody) Read(b []byte) (int, error) {
+	n, err := this.ReadCloser.Read(b)
+	atomic.AddInt64(this.n, int64(n))
+	return n, err
+}
+
+// responseWriter 记录写回客户端的Http Status和body字节数
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (this *responseWriter) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *responseWriter) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	n, err := this.ResponseWriter.Write(b)
+	this.bytes += int64(n)
+	return n, err
+}
+
+func (this *responseWriter) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+func (this *responseWriter) Flush() {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (this *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := this.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not supported")
+}
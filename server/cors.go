@@ -0,0 +1,180 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProxyCors 跨域访问策略
+// 预检请求由代理直接响应，其他请求在响应中加入跨域相关的header
+// 允许的Origin会被原样返回，不会返回`*`
+type ProxyCors struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	patterns         []*regexp.Regexp
+	allowMethods     []string
+	allowHeaders     []string
+	exposeHeaders    []string
+	allowCredentials bool
+	maxAge           int
+}
+
+func NewProxyCors(cors *Cors) *ProxyCors {
+	ret := &ProxyCors{
+		origins:          map[string]bool{},
+		patterns:         []*regexp.Regexp{},
+		allowMethods:     cors.AllowMethods,
+		allowHeaders:     cors.AllowHeaders,
+		exposeHeaders:    cors.ExposeHeaders,
+		allowCredentials: cors.AllowCredentials,
+		maxAge:           cors.MaxAge,
+	}
+	if len(ret.allowMethods) == 0 {
+		ret.allowMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	for _, origin := range cors.AllowOrigins {
+		switch {
+		case origin == "*":
+			ret.anyOrigin = true
+		case strings.HasPrefix(origin, "~"):
+			// 正则需要匹配完整的Origin
+			if re, err := regexp.Compile("^(?:" + origin[1:] + ")$"); err == nil {
+				ret.patterns = append(ret.patterns, re)
+			}
+		default:
+			ret.origins[strings.ToLower(origin)] = true
+		}
+	}
+	return ret
+}
+
+// isPreflight 带有Origin和Access-Control-Request-Method的OPTIONS请求为预检请求
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (this *ProxyCors) allowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if this.anyOrigin || this.origins[strings.ToLower(origin)] {
+		return true
+	}
+	for _, re := range this.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *ProxyCors) allowMethod(method string) bool {
+	for _, m := range this.allowMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRequestHeaders 预检请求中的header都需要在allow_headers中
+func (this *ProxyCors) allowRequestHeaders(headers []string) bool {
+	for _, header := range headers {
+		allow := false
+		for _, h := range this.allowHeaders {
+			if strings.EqualFold(h, header) {
+				allow = true
+				break
+			}
+		}
+		if !allow {
+			return false
+		}
+	}
+	return true
+}
+
+// preflight 直接响应预检请求，不满足策略时返回403
+func (this *ProxyCors) preflight(c *Context) {
+	header := c.w.Header()
+	addVary(header, "Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers")
+	origin := c.req.Header.Get("Origin")
+	method := c.req.Header.Get("Access-Control-Request-Method")
+	requestHeaders := splitHeaderList(c.req.Header.Values("Access-Control-Request-Headers"))
+	if !this.allowOrigin(origin) || !this.allowMethod(method) || !this.allowRequestHeaders(requestHeaders) {
+		c.variables.Set("error_message", fmt.Sprintf("cors preflight rejected %s %s", origin, method))
+		c.variables.Set("status", "403")
+		http.Error(c.w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(this.allowMethods, ", "))
+	if len(this.allowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(this.allowHeaders, ", "))
+	}
+	if this.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if this.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(this.maxAge))
+	}
+	c.variables.Set("status", "204")
+	c.w.WriteHeader(http.StatusNoContent)
+}
+
+// process 为非预检请求的响应设置跨域header
+// 目标地址返回的跨域header会被移除，以代理的策略为准
+func (this *ProxyCors) process(header http.Header, origin string) {
+	for k := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			header.Del(k)
+		}
+	}
+	addVary(header, "Origin")
+	if !this.allowOrigin(origin) {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if this.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(this.exposeHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(this.exposeHeaders, ", "))
+	}
+}
+
+// addVary 向Vary中追加尚未包含的header
+func addVary(header http.Header, keys ...string) {
+	exist := splitHeaderList(header.Values("Vary"))
+	for _, key := range keys {
+		found := false
+		for _, e := range exist {
+			if e == "*" || strings.EqualFold(e, key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			header.Add("Vary", key)
+			exist = append(exist, key)
+		}
+	}
+}
+
+// splitHeaderList 拆分以逗号分隔的header值
+func splitHeaderList(values []string) []string {
+	ret := []string{}
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsCheckWildcardWithCredentials(t *testing.T) {
+	cors := &Cors{AllowOrigins: []string{"*"}, AllowCredentials: true}
+	if err := cors.check("cors"); err == nil {
+		t.Error("expect error for * with credentials")
+	}
+	cors.AllowCredentials = false
+	if err := cors.check("cors"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	cases := []struct {
+		cors    *Cors
+		origin  string
+		method  string
+		headers string
+		status  int
+	}{
+		{&Cors{AllowOrigins: []string{"https://a.com"}}, "https://a.com", "GET", "", 204},
+		{&Cors{AllowOrigins: []string{"https://a.com"}}, "https://b.com", "GET", "", 403},
+		{&Cors{AllowOrigins: []string{"https://a.com"}}, "https://a.com", "PUT", "", 403},
+		{&Cors{AllowOrigins: []string{"https://a.com"}}, "https://a.com", "GET", "Authorization", 403},
+		{&Cors{AllowOrigins: []string{"https://a.com"}, AllowHeaders: []string{"Authorization"}}, "https://a.com", "GET", "authorization", 204},
+		{&Cors{AllowOrigins: []string{"~https://[a-z]+\\.a\\.com"}}, "https://x.a.com", "GET", "", 204},
+		{&Cors{AllowOrigins: []string{"~https://[a-z]+\\.a\\.com"}}, "https://x.a.com.evil.com", "GET", "", 403},
+	}
+	for i, tc := range cases {
+		req := httptest.NewRequest("OPTIONS", "/", nil)
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Access-Control-Request-Method", tc.method)
+		if tc.headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", tc.headers)
+		}
+		w := httptest.NewRecorder()
+		c := NewContext(w, req)
+		NewProxyCors(tc.cors).preflight(c)
+		if w.Code != tc.status {
+			t.Errorf("case %d: expect status %d, got %d", i, tc.status, w.Code)
+		}
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		if (tc.status == 204) != (allowOrigin == tc.origin) {
+			t.Errorf("case %d: unexpected Access-Control-Allow-Origin %q", i, allowOrigin)
+		}
+	}
+}
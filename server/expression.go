@@ -0,0 +1,400 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// MatchExpr 规则匹配表达式
+// 表达式在加载配置时编译，请求时基于变量集合求值，语法如下：
+//
+//	expr    := or
+//	or      := and ( "||" and )*
+//	and     := unary ( "&&" unary )*
+//	unary   := "!" unary | primary
+//	primary := "(" expr ")" | operand [ cmp operand | "in" list ]
+//	cmp     := "==" | "!=" | "^=" | "~" | "!~"
+//	list    := "[" operand ( "," operand )* "]"
+//	operand := $name | ${name} | ${name|modifier} | "string" | 'string'
+//
+// 单独的operand在值不为空时为真，如：`$cookie_session`
+type MatchExpr struct {
+	src  string
+	root exprNode
+}
+
+// NewMatchExpr 编译表达式
+func NewMatchExpr(src string) (*MatchExpr, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.end() {
+		return nil, fmt.Errorf("unexpected token %s at %d", p.peek().text, p.peek().pos)
+	}
+	return &MatchExpr{src: src, root: root}, nil
+}
+
+func (this *MatchExpr) eval(variables *ProxyVariable) bool {
+	ret := this.root.eval(variables)
+	debug(fmt.Sprintf("match expression(%v) %s", ret, this.src))
+	return ret
+}
+
+type exprNode interface {
+	eval(variables *ProxyVariable) bool
+}
+
+type exprOperand interface {
+	value(variables *ProxyVariable) string
+}
+
+type exprVariable struct{ ref *variableRef }
+
+func (this *exprVariable) value(variables *ProxyVariable) string {
+	variables.mux.RLock()
+	defer variables.mux.RUnlock()
+	v, _ := this.ref.value(variables.data)
+	return v
+}
+
+type exprString struct{ str string }
+
+func (this *exprString) value(variables *ProxyVariable) string {
+	return this.str
+}
+
+type exprOr struct{ left, right exprNode }
+
+func (this *exprOr) eval(variables *ProxyVariable) bool {
+	return this.left.eval(variables) || this.right.eval(variables)
+}
+
+type exprAnd struct{ left, right exprNode }
+
+func (this *exprAnd) eval(variables *ProxyVariable) bool {
+	return this.left.eval(variables) && this.right.eval(variables)
+}
+
+type exprNot struct{ node exprNode }
+
+func (this *exprNot) eval(variables *ProxyVariable) bool {
+	return !this.node.eval(variables)
+}
+
+type exprTruthy struct{ operand exprOperand }
+
+func (this *exprTruthy) eval(variables *ProxyVariable) bool {
+	return this.operand.value(variables) != ""
+}
+
+type exprCompare struct {
+	op          string
+	left, right exprOperand
+}
+
+func (this *exprCompare) eval(variables *ProxyVariable) bool {
+	left := this.left.value(variables)
+	right := this.right.value(variables)
+	switch this.op {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	case "^=":
+		return strings.HasPrefix(left, right)
+	}
+	return false
+}
+
+type exprRegexp struct {
+	negative bool
+	left     exprOperand
+	re       *regexp.Regexp
+}
+
+func (this *exprRegexp) eval(variables *ProxyVariable) bool {
+	return this.re.MatchString(this.left.value(variables)) != this.negative
+}
+
+// exprIn 判断值是否在列表中，列表中的CIDR常量按照ip网段进行匹配
+type exprIn struct {
+	left     exprOperand
+	operands []exprOperand
+	ipnets   []*net.IPNet
+}
+
+func (this *exprIn) eval(variables *ProxyVariable) bool {
+	left := this.left.value(variables)
+	for _, operand := range this.operands {
+		if operand.value(variables) == left {
+			return true
+		}
+	}
+	if len(this.ipnets) > 0 {
+		if ip := net.ParseIP(left); ip != nil {
+			for _, ipnet := range this.ipnets {
+				if ipnet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+const (
+	_EXPR_TOKEN_OP = iota
+	_EXPR_TOKEN_STRING
+	_EXPR_TOKEN_VARIABLE
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func tokenizeExpr(src string) ([]*exprToken, error) {
+	tokens := []*exprToken{}
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "&&"), strings.HasPrefix(src[i:], "||"),
+			strings.HasPrefix(src[i:], "=="), strings.HasPrefix(src[i:], "!="),
+			strings.HasPrefix(src[i:], "!~"), strings.HasPrefix(src[i:], "^="):
+			tokens = append(tokens, &exprToken{kind: _EXPR_TOKEN_OP, text: src[i : i+2], pos: i})
+			i += 2
+		case strings.ContainsRune("()[],!~", rune(ch)):
+			tokens = append(tokens, &exprToken{kind: _EXPR_TOKEN_OP, text: src[i : i+1], pos: i})
+			i++
+		case ch == '"' || ch == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != ch; j++ {
+				// 只转义引号和反斜杠本身，正则中的`\w`等保持原样
+				if src[j] == '\\' && j+1 < len(src) && (src[j+1] == ch || src[j+1] == '\\') {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, &exprToken{kind: _EXPR_TOKEN_STRING, text: sb.String(), pos: i})
+			i = j + 1
+		case ch == '$':
+			name, n := scanVariableName(src[i:])
+			if name == "" {
+				return nil, fmt.Errorf("invalid variable at %d", i)
+			}
+			tokens = append(tokens, &exprToken{kind: _EXPR_TOKEN_VARIABLE, text: name, pos: i})
+			i += n
+		case strings.HasPrefix(src[i:], "in") && (i+2 == len(src) || !isVariableNameChar(src[i+2])):
+			tokens = append(tokens, &exprToken{kind: _EXPR_TOKEN_OP, text: "in", pos: i})
+			i += 2
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", ch, i)
+		}
+	}
+	return tokens, nil
+}
+
+// scanVariableName 读取`$name`或`${name}`形式的变量，返回变量名和所占的长度
+func scanVariableName(src string) (string, int) {
+	if len(src) < 2 || src[0] != '$' {
+		return "", 0
+	}
+	if src[1] == '{' {
+		end := strings.IndexByte(src, '}')
+		if end < 0 {
+			return "", 0
+		}
+		return src[2:end], end + 1
+	}
+	i := 1
+	if src[1] >= '0' && src[1] <= '9' {
+		// 数字变量只包含数字，避免$1abc被当作变量名
+		for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+			i++
+		}
+		return src[1:i], i
+	}
+	for i < len(src) && isVariableNameChar(src[i]) {
+		i++
+	}
+	// 变量名不以-结尾，如：`$remote_ip-$status`
+	for i > 1 && src[i-1] == '-' {
+		i--
+	}
+	return src[1:i], i
+}
+
+func isVariableNameChar(ch byte) bool {
+	return ch == '_' || ch == '-' ||
+		(ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+type exprParser struct {
+	tokens []*exprToken
+	index  int
+}
+
+func (this *exprParser) end() bool {
+	return this.index >= len(this.tokens)
+}
+
+func (this *exprParser) peek() *exprToken {
+	if this.end() {
+		return &exprToken{kind: _EXPR_TOKEN_OP, text: "EOF", pos: -1}
+	}
+	return this.tokens[this.index]
+}
+
+func (this *exprParser) accept(op string) bool {
+	if t := this.peek(); !this.end() && t.kind == _EXPR_TOKEN_OP && t.text == op {
+		this.index++
+		return true
+	}
+	return false
+}
+
+func (this *exprParser) parseOr() (exprNode, error) {
+	left, err := this.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for this.accept("||") {
+		right, err := this.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (this *exprParser) parseAnd() (exprNode, error) {
+	left, err := this.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for this.accept("&&") {
+		right, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (this *exprParser) parseUnary() (exprNode, error) {
+	if this.accept("!") {
+		node, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{node: node}, nil
+	}
+	return this.parsePrimary()
+}
+
+func (this *exprParser) parsePrimary() (exprNode, error) {
+	if this.accept("(") {
+		node, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !this.accept(")") {
+			return nil, fmt.Errorf("expect ) at %d", this.peek().pos)
+		}
+		return node, nil
+	}
+	left, err := this.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := this.peek()
+	if this.end() || t.kind != _EXPR_TOKEN_OP {
+		return &exprTruthy{operand: left}, nil
+	}
+	switch t.text {
+	case "==", "!=", "^=":
+		this.index++
+		right, err := this.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &exprCompare{op: t.text, left: left, right: right}, nil
+	case "~", "!~":
+		this.index++
+		pattern := this.peek()
+		if this.end() || pattern.kind != _EXPR_TOKEN_STRING {
+			return nil, fmt.Errorf("expect regexp string at %d", pattern.pos)
+		}
+		this.index++
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, err
+		}
+		return &exprRegexp{negative: t.text == "!~", left: left, re: re}, nil
+	case "in":
+		this.index++
+		return this.parseList(left)
+	}
+	return &exprTruthy{operand: left}, nil
+}
+
+func (this *exprParser) parseList(left exprOperand) (exprNode, error) {
+	if !this.accept("[") {
+		return nil, fmt.Errorf("expect [ at %d", this.peek().pos)
+	}
+	ret := &exprIn{left: left, operands: []exprOperand{}, ipnets: []*net.IPNet{}}
+	for {
+		operand, err := this.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		ret.operands = append(ret.operands, operand)
+		if str, ok := operand.(*exprString); ok && strings.Contains(str.str, "/") {
+			if _, ipnet, err := net.ParseCIDR(str.str); err == nil {
+				ret.ipnets = append(ret.ipnets, ipnet)
+			}
+		}
+		if this.accept("]") {
+			return ret, nil
+		}
+		if !this.accept(",") {
+			return nil, fmt.Errorf("expect , or ] at %d", this.peek().pos)
+		}
+	}
+}
+
+func (this *exprParser) parseOperand() (exprOperand, error) {
+	t := this.peek()
+	switch {
+	case this.end():
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t.kind == _EXPR_TOKEN_VARIABLE:
+		this.index++
+		ref, err := parseVariableRef(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid variable at %d: %v", t.pos, err)
+		}
+		return &exprVariable{ref: ref}, nil
+	case t.kind == _EXPR_TOKEN_STRING:
+		this.index++
+		return &exprString{str: t.text}, nil
+	}
+	return nil, fmt.Errorf("unexpected token %s at %d", t.text, t.pos)
+}
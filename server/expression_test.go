@@ -0,0 +1,71 @@
+package service
+
+import "testing"
+
+func TestMatchExprEval(t *testing.T) {
+	variables := NewProxyVariable()
+	variables.Set("uri_path", "/admin/users")
+	variables.Set("method", "POST")
+	variables.Set("header_X-Admin", "1")
+	variables.Set("remote_ip", "10.1.2.3")
+	variables.Set("empty", "")
+	cases := []struct {
+		expr   string
+		expect bool
+	}{
+		{`$method == "POST"`, true},
+		{`$method != "POST"`, false},
+		{`$uri_path ^= "/admin"`, true},
+		{`$uri_path ~ "^/admin/\w+$"`, true},
+		{`$uri_path !~ "^/admin"`, false},
+		{`$method in ["GET", "POST"]`, true},
+		{`$method in ['GET', 'PUT']`, false},
+		{`$remote_ip in ["10.0.0.0/8"]`, true},
+		{`$remote_ip in ["192.168.0.0/16", "127.0.0.1"]`, false},
+		{`$header_X-Admin`, true},
+		{`$empty`, false},
+		{`$missing`, false},
+		{`!$missing`, true},
+		{`${method|lower} == "post"`, true},
+		{`${missing|default:x} == "x"`, true},
+		{`$method == "GET" || $header_X-Admin == "1"`, true},
+		{`$method == "GET" || $header_X-Admin == "1" && $empty`, false},
+		{`($method == "GET" || $header_X-Admin == "1") && !$empty`, true},
+		{`!($remote_ip in ["10.0.0.0/8"])`, false},
+		{`!!$method`, true},
+		{`$header_X-Admin == "\"1\""`, false},
+		{`$uri_path ~ "^/admin/\\w"`, true},
+		{`$uri_path ~ "^/admin" && ($header_X-Admin == "1" || $cookie_admin) && !($remote_ip in ["192.168.0.0/16"])`, true},
+	}
+	for _, tc := range cases {
+		expr, err := NewMatchExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := expr.eval(variables); got != tc.expect {
+			t.Errorf("%s: expect %v, got %v", tc.expr, tc.expect, got)
+		}
+	}
+}
+
+func TestMatchExprError(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`$a ==`,
+		`$a == "b`,
+		`($a == "b"`,
+		`$a == "b")`,
+		`$a ~ $b`,
+		`$a ~ "("`,
+		`$a in "b"`,
+		`$a in ["b"`,
+		`$a && || $b`,
+		`$a = "b"`,
+		`${a|unknown}`,
+	} {
+		if _, err := NewMatchExpr(expr); err == nil {
+			t.Errorf("%s: expect error", expr)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyTrustedProxies 可信任的代理网段
+// 只有来自可信代理的请求，才会保留请求中的X-Forwarded-*和Forwarded header
+type ProxyTrustedProxies struct {
+	ipnets []*net.IPNet
+}
+
+func NewProxyTrustedProxies() *ProxyTrustedProxies {
+	return &ProxyTrustedProxies{ipnets: []*net.IPNet{}}
+}
+
+func (this *ProxyTrustedProxies) add(addrs []string) {
+	for _, addr := range addrs {
+		if ipnet, err := parseCIDR(addr); err == nil {
+			this.ipnets = append(this.ipnets, ipnet)
+		}
+	}
+}
+
+func (this *ProxyTrustedProxies) contains(addr string) bool {
+	if this == nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range this.ipnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders 设置发送给目标地址的X-Forwarded-For、X-Forwarded-Proto、X-Forwarded-Host和Forwarded
+// 请求方不是可信代理时，丢弃请求中原有的这些header
+func setForwardedHeaders(req *http.Request, c *Context) {
+	if !c.trusted {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("Forwarded")
+	}
+
+	// X-Forwarded-For由ReverseProxy在原有值的基础上追加请求方ip
+	if c.forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", c.forwardedFor)
+	} else {
+		req.Header.Del("X-Forwarded-For")
+	}
+
+	proto := "http"
+	if c.req.TLS != nil {
+		proto = "https"
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", c.req.Host)
+	}
+
+	forwarded := "for=" + forwardedNode(c.peerIp) + ";host=" + forwardedValue(c.req.Host) + ";proto=" + proto
+	if prior := strings.Join(req.Header.Values("Forwarded"), ", "); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+// forwardedNode RFC 7239中的节点，ipv6地址需要加上方括号和引号
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "\"[" + ip + "]\""
+	}
+	return ip
+}
+
+func forwardedValue(value string) string {
+	if strings.ContainsAny(value, ":;,\" ") {
+		return "\"" + strings.Replace(value, "\"", "\\\"", -1) + "\""
+	}
+	return value
+}
+
+// 获取真实客户端ip的方式
+const (
+	_REAL_IP_X_FORWARDED_FOR = "x_forwarded_for"
+	_REAL_IP_X_REAL_IP       = "x_real_ip"
+	_REAL_IP_PROXY_PROTOCOL  = "proxy_protocol"
+)
+
+// realClientIp 获取真实客户端ip，请求方不是可信代理时直接使用请求方ip
+// 使用X-Forwarded-For时从右向左查找第一个不是可信代理的ip
+// PROXY protocol在建立连接时已经替换了请求方地址，这里不需要处理
+func (this *ProxyTrustedProxies) realClientIp(req *http.Request, peerIp, source string) string {
+	if !this.contains(peerIp) {
+		return peerIp
+	}
+	switch source {
+	case _REAL_IP_X_FORWARDED_FOR:
+		ret := peerIp
+		ips := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if net.ParseIP(ip) == nil {
+				break
+			}
+			ret = ip
+			if !this.contains(ip) {
+				break
+			}
+		}
+		return ret
+	case _REAL_IP_X_REAL_IP:
+		if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	return peerIp
+}
+
+// remoteAddrIp 去掉地址中的端口
+func remoteAddrIp(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
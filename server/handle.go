@@ -2,50 +2,134 @@ package service
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 type ProxyHandles struct {
-	domains  map[string]*ProxyDomain
-	services *ProxyServices
-	logfmts  *ProxyLogfmts
-	logger   *ProxyLogger
+	domains   map[string]*ProxyDomain
+	wildcards []*ProxyDomainPattern
+	regexps   []*ProxyDomainPattern
+	services  *ProxyServices
+	logfmts   *ProxyLogfmts
+	logger    *ProxyLogger
+
+	// defaultDomain 当前端口的默认domain，没有匹配到域名的请求将使用它的rule
+	defaultDomain *ProxyDomain
 }
 
 func NewProxyHandles(logger *ProxyLogger) *ProxyHandles {
 	return &ProxyHandles{
-		domains: make(map[string]*ProxyDomain),
-		logger:  logger,
+		domains:   make(map[string]*ProxyDomain),
+		wildcards: []*ProxyDomainPattern{},
+		regexps:   []*ProxyDomainPattern{},
+		logger:    logger,
 	}
 }
 
 func (this *ProxyHandles) stop() {
-	for _, d := range this.domains {
+	for _, d := range this.all() {
 		d.services.stop()
 		debug("cleanup hanles services done")
 		d.accessLog.Close()
 		debug("cleanup hanles access log done")
 		d.errorLog.Close()
 		debug("cleanup hanles error log done")
+		for _, rule := range d.rules {
+			if rule.mirror != nil {
+				rule.mirror.stop()
+			}
+		}
+	}
+}
+
+// all 返回全部domain，包括通配符和正则匹配的domain
+func (this *ProxyHandles) all() []*ProxyDomain {
+	ret := []*ProxyDomain{}
+	for _, d := range this.domains {
+		ret = append(ret, d)
 	}
+	for _, p := range this.wildcards {
+		ret = append(ret, p.domain)
+	}
+	for _, p := range this.regexps {
+		ret = append(ret, p.domain)
+	}
+	return ret
 }
 
 func (this *ProxyHandles) add(app *App) {
-	for _, d := range app.Domains {
-		if _, ok := this.domains[d.Domain]; ok {
-			this.logger.Error("found duplicate domain:", d.Domain)
-		} else {
-			this.domains[d.Domain] = this.NewProxyDomain(app, d, this.services, this.logfmts, this.logger)
+	for i, d := range app.Domains {
+		var domain *ProxyDomain
+		switch {
+		case strings.HasPrefix(d.Domain, "~"):
+			re, err := regexp.Compile(d.Domain[1:])
+			if err != nil {
+				this.logger.Error("invalid domain regexp:", d.Domain, err)
+				continue
+			}
+			if this.findPattern(this.regexps, d.Domain) {
+				this.logger.Error("found duplicate domain:", d.Domain)
+				continue
+			}
+			domain = this.NewProxyDomain(app, d, this.services, this.logfmts, this.logger)
+			this.regexps = append(this.regexps, &ProxyDomainPattern{
+				src:    d.Domain,
+				re:     re,
+				domain: domain,
+			})
+		case strings.HasPrefix(d.Domain, "*."):
+			if this.findPattern(this.wildcards, d.Domain) {
+				this.logger.Error("found duplicate domain:", d.Domain)
+				continue
+			}
+			domain = this.NewProxyDomain(app, d, this.services, this.logfmts, this.logger)
+			this.wildcards = append(this.wildcards, &ProxyDomainPattern{
+				src:    d.Domain,
+				suffix: d.Domain[1:],
+				domain: domain,
+			})
+			// 最长的通配符优先匹配
+			sort.SliceStable(this.wildcards, func(i, j int) bool {
+				return len(this.wildcards[i].suffix) > len(this.wildcards[j].suffix)
+			})
+		default:
+			if _, ok := this.domains[d.Domain]; ok {
+				this.logger.Error("found duplicate domain:", d.Domain)
+				continue
+			}
+			domain = this.NewProxyDomain(app, d, this.services, this.logfmts, this.logger)
+			this.domains[d.Domain] = domain
+		}
+
+		// app设置为default时，使用app的第一个domain作为默认domain
+		if d.Default || (app.Default && i == 0) {
+			if this.defaultDomain != nil {
+				this.logger.Error("found duplicate default domain:", d.Domain)
+			} else {
+				this.defaultDomain = domain
+			}
 		}
 	}
 }
 
+func (this *ProxyHandles) findPattern(patterns []*ProxyDomainPattern, src string) bool {
+	for _, p := range patterns {
+		if p.src == src {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *ProxyHandles) setGlobalService(services *ProxyServices) {
 	this.services = services
 }
@@ -62,22 +146,93 @@ func (this *ProxyHandles) match(c *Context) (*ProxyHandle, bool) {
 	} else {
 		domainString = c.req.Host
 	}
+	domainString = strings.ToLower(domainString)
 
-	domain, exist := this.domains[domainString]
+	domain, exist := this.matchDomain(c, domainString)
 	debug(fmt.Sprintf("match domain(%v) %s", exist, domainString))
 	if !exist {
-		return nil, false
+		if this.defaultDomain == nil {
+			return nil, false
+		}
+		debug("using default domain", domainString)
+		domain = this.defaultDomain
 	}
-	for _, rule := range domain.rules {
+	c.domain = domain
+	for _, index := range domain.index.candidates(c.req.URL.Path) {
+		rule := domain.rules[index]
 		if rule.match(c) {
+			c.variables.Set("rule_name", rule.name)
 			return rule, true
 		}
 	}
 	return nil, false
 }
 
+// notFound 处理没有匹配到rule的请求
+// 请求日志优先写入所匹配domain的access log，其次是默认domain的access log，都没有则写入系统日志
+func (this *ProxyHandles) notFound(c *Context) {
+	domain := c.domain
+	if domain == nil {
+		domain = this.defaultDomain
+	}
+	// 没有rule匹配预检请求时，由domain的cors响应
+	if domain != nil && domain.cors != nil && isPreflight(c.req) {
+		domain.cors.preflight(c)
+		c.end()
+		domain.accessLog.Logfmt(c.variables)
+		return
+	}
+	c.variables.Set("status", "404")
+	c.variables.Set("error_message", "no rule matched")
+	Handler404(c.w, c.req)
+	c.end()
+
+	if domain == nil {
+		this.logger.Error("no domain matched:", c.req.Method, c.req.Host, c.req.RequestURI)
+		return
+	}
+	domain.accessLog.Logfmt(c.variables)
+}
+
+// matchDomain 按照精确匹配、最长通配符、正则(配置顺序)的顺序查找domain
+// 通配符和正则匹配到的内容会写入变量$domain_n中
+func (this *ProxyHandles) matchDomain(c *Context, host string) (*ProxyDomain, bool) {
+	if domain, exist := this.domains[host]; exist {
+		return domain, true
+	}
+	for _, p := range this.wildcards {
+		if len(host) > len(p.suffix) && strings.HasSuffix(host, p.suffix) {
+			debug(fmt.Sprintf("match domain wildcard %s->%s", p.src, host))
+			c.variables.Set("domain_0", host)
+			c.variables.Set("domain_1", host[:len(host)-len(p.suffix)])
+			return p.domain, true
+		}
+	}
+	for _, p := range this.regexps {
+		if g := p.re.FindStringSubmatch(host); g != nil {
+			debug(fmt.Sprintf("match domain regexp %s->%s", p.src, host))
+			for i, ge := range g {
+				c.variables.Set(fmt.Sprintf("domain_%d", i), ge)
+			}
+			setNamedSubmatchVariables(c.variables, p.re, g)
+			return p.domain, true
+		}
+	}
+	return nil, false
+}
+
+// ProxyDomainPattern 通配符(*.example.com)或正则(~regexp)形式的domain
+type ProxyDomainPattern struct {
+	src    string
+	suffix string
+	re     *regexp.Regexp
+	domain *ProxyDomain
+}
+
 type ProxyDomain struct {
 	rules     []*ProxyHandle
+	index     *ProxyRuleIndex
+	cors      *ProxyCors
 	services  *ProxyServices
 	accessLog *ProxyLogger
 	errorLog  *ProxyLogger
@@ -86,10 +241,8 @@ type ProxyDomain struct {
 
 func (this *ProxyHandles) NewProxyDomain(app *App, domain *Domain, services *ProxyServices, logfmts *ProxyLogfmts, syslog *ProxyLogger) *ProxyDomain {
 	ret := &ProxyDomain{
-		services:  NewProxyServices(app.Services),
-		accessLog: NewProxyLogger(),
-		errorLog:  NewProxyLogger(),
-		syslog:    syslog,
+		services: NewProxyServices(app.Services),
+		syslog:   syslog,
 	}
 
 	// 绑定上一级services
@@ -97,41 +250,86 @@ func (this *ProxyHandles) NewProxyDomain(app *App, domain *Domain, services *Pro
 
 	// init logger
 	appLogfmts := NewProxyLogfmts(app.Logfmts)
-	if _, err := ret.accessLog.Load(app.AccessLog); err != nil {
-		this.logger.Error(err)
+	ret.accessLog = this.newLogger(app.AccessLog, appLogfmts, logfmts)
+	ret.errorLog = this.newLogger(app.ErrorLog, appLogfmts, logfmts)
+
+	if domain.Cors != nil {
+		ret.cors = NewProxyCors(domain.Cors)
 	}
-	if _, err := ret.accessLog.LoadFmt(appLogfmts); err != nil {
-		if logfmts != nil {
-			if _, err := ret.accessLog.LoadFmt(logfmts); err != nil {
-				this.logger.Error(err)
+
+	// add rules
+	names := map[string]bool{}
+	for i, rule := range domain.Rules {
+		if rule == nil {
+			continue
+		}
+		handle := NewProxyHandle(rule, ret.services, ret.accessLog, ret.errorLog, ret.syslog)
+		// rule中没有配置cors时使用domain的cors
+		if handle.cors == nil {
+			handle.cors = ret.cors
+		}
+		if rule.Mirror != nil {
+			if rule.Mirror.ErrorLog != nil {
+				handle.mirror = NewProxyMirror(rule.Mirror, ret.services, this.newLogger(rule.Mirror.ErrorLog, appLogfmts, logfmts), true)
+			} else {
+				handle.mirror = NewProxyMirror(rule.Mirror, ret.services, ret.errorLog, false)
 			}
 		}
+		if handle.name == "" {
+			handle.name = fmt.Sprintf("rules_%d", i)
+		}
+		if names[handle.name] {
+			this.logger.Error("found duplicate rule name:", domain.Domain, handle.name)
+		}
+		names[handle.name] = true
+		ret.rules = append(ret.rules, handle)
 	}
+	// priority越大越优先，相同priority的rule保持配置顺序
+	sort.SliceStable(ret.rules, func(i, j int) bool {
+		return ret.rules[i].priority > ret.rules[j].priority
+	})
+	ret.index = NewProxyRuleIndex(ret.rules)
 
-	if _, err := ret.errorLog.Load(app.ErrorLog); err != nil {
+	return ret
+}
+
+// newLogger 加载日志配置，日志格式优先使用app中的定义
+func (this *ProxyHandles) newLogger(config *Log, appLogfmts, logfmts *ProxyLogfmts) *ProxyLogger {
+	ret := NewProxyLogger()
+	if _, err := ret.Load(config); err != nil {
 		this.logger.Error(err)
 	}
-	if _, err := ret.errorLog.LoadFmt(appLogfmts); err != nil {
+	if _, err := ret.LoadFmt(appLogfmts); err != nil {
 		if logfmts != nil {
-			if _, err := ret.errorLog.LoadFmt(logfmts); err != nil {
+			if _, err := ret.LoadFmt(logfmts); err != nil {
 				this.logger.Error(err)
 			}
 		}
 	}
-
-	// add rules
-	for _, rule := range domain.Rules {
-		ret.rules = append(ret.rules, NewProxyHandle(rule, ret.services, ret.accessLog, ret.errorLog, ret.syslog))
-	}
-
 	return ret
 }
 
 type ProxyHandle struct {
+	name             string
+	priority         int
 	tr               http.RoundTripper
 	filters          []*ProxyHandleFilter
-	target           *ProxyTarget
+	expr             *MatchExpr
+	targets          []*ProxyTarget
+	totalWeight      int
+	sticky           *VariableExpr
+	mirror           *ProxyMirror
+	ret              *ProxyReturn
+	static           *ProxyStatic
+	rewrite          *ProxyRewrite
+	preserveHost     bool
+	cors             *ProxyCors
 	headerTransforms []*ProxyHeaderTransform
+	bodyTransform    *ProxyBodyTransform
+	queryTransforms  []*ProxyQueryTransform
+	cookieTransforms []*ProxyCookieTransform
+	jsonTransforms   []*ProxyJsonTransform
+	maxBodySize      int64
 	services         *ProxyServices
 	accessLog        *ProxyLogger
 	errorLog         *ProxyLogger
@@ -140,30 +338,113 @@ type ProxyHandle struct {
 
 func NewProxyHandle(rule *Rule, services *ProxyServices, accessLogger, errorLogger, sysLogger *ProxyLogger) *ProxyHandle {
 	ret := &ProxyHandle{
+		name:             rule.Name,
+		priority:         rule.Priority,
+		preserveHost:     rule.PreserveHost,
 		tr:               http.DefaultTransport,
 		filters:          []*ProxyHandleFilter{},
-		target:           NewProxyTarget(rule.To),
+		targets:          []*ProxyTarget{},
 		headerTransforms: []*ProxyHeaderTransform{},
+		queryTransforms:  []*ProxyQueryTransform{},
+		cookieTransforms: []*ProxyCookieTransform{},
+		jsonTransforms:   []*ProxyJsonTransform{},
 		services:         services,
 		accessLog:        accessLogger,
 		errorLog:         errorLogger,
 		syslog:           sysLogger,
 	}
 
+	for _, target := range rule.To {
+		if target == nil {
+			continue
+		}
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		ret.targets = append(ret.targets, NewProxyTarget(target.To, weight))
+		ret.totalWeight += weight
+	}
+	ret.static = NewProxyStatic(rule.Static)
+	if rule.Rewrite != nil {
+		ret.rewrite = NewProxyRewrite(rule.Rewrite)
+	}
+	if rule.Return != nil {
+		ret.ret = NewProxyReturn(rule.Return)
+	}
+	if rule.Cors != nil {
+		ret.cors = NewProxyCors(rule.Cors)
+	}
+	if rule.Sticky != "" {
+		ret.sticky = NewVariableExpr(rule.Sticky)
+	}
 	for _, filter := range rule.Filters {
 		ret.filters = append(ret.filters, NewProxyHandleFilter(filter))
 	}
+	if rule.Match != "" {
+		if expr, err := NewMatchExpr(rule.Match); err != nil {
+			sysLogger.Error("invalid match expression:", rule.Match, err)
+		} else {
+			ret.expr = expr
+		}
+	}
+	ret.maxBodySize = 1 << 20
 	if rule.Transform != nil {
 		if rule.Transform.Headers != nil {
 			for _, headerTransform := range rule.Transform.Headers {
 				ret.headerTransforms = append(ret.headerTransforms, NewProxyHeaderTransform(headerTransform))
 			}
 		}
+		for _, queryTransform := range rule.Transform.Queries {
+			if queryTransform != nil {
+				ret.queryTransforms = append(ret.queryTransforms, NewProxyQueryTransform(queryTransform))
+			}
+		}
+		for _, cookieTransform := range rule.Transform.Cookies {
+			if cookieTransform != nil {
+				ret.cookieTransforms = append(ret.cookieTransforms, NewProxyCookieTransform(cookieTransform))
+			}
+		}
+		if rule.Transform.Body != nil {
+			ret.bodyTransform = NewProxyBodyTransform(rule.Transform.Body)
+		}
+		for _, jsonTransform := range rule.Transform.Json {
+			if jsonTransform != nil {
+				ret.jsonTransforms = append(ret.jsonTransforms, NewProxyJsonTransform(jsonTransform))
+			}
+		}
+		if rule.Transform.MaxBodySize > 0 {
+			ret.maxBodySize = rule.Transform.MaxBodySize
+		}
 	}
 	return ret
 }
 
+// match filters和match表达式都满足时才匹配当前规则
 func (this *ProxyHandle) match(c *Context) bool {
+	if !this.matchFilters(c) {
+		return false
+	}
+	if this.expr != nil {
+		return this.expr.eval(c.variables)
+	}
+	return true
+}
+
+// indexable 所有filter都限定了path时，rule可以加入前缀索引
+func (this *ProxyHandle) indexable() bool {
+	if len(this.filters) == 0 {
+		return false
+	}
+	for _, filter := range this.filters {
+		if filter.prefix == "" && filter.exactPath == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *ProxyHandle) matchFilters(c *Context) bool {
 	if len(this.filters) == 0 {
 		return true
 	}
@@ -181,9 +462,7 @@ func (this *ProxyHandle) match(c *Context) bool {
 func (this *ProxyHandle) serve(c *Context) {
 	hasError := false
 	defer func() {
-		c.endAt = time.Now()
-		c.variables.Set("request_end", c.endAt.Format("2006/01/02 15:04:05"))
-		c.variables.Set("latency", fmt.Sprintf("%d", c.endAt.Sub(c.startAt).Nanoseconds()/int64(time.Millisecond)))
+		c.end()
 
 		this.accessLog.Logfmt(c.variables)
 		if hasError {
@@ -191,22 +470,32 @@ func (this *ProxyHandle) serve(c *Context) {
 		}
 	}()
 
-	remoteIp := c.req.RemoteAddr
-	if xffHost, _, err := net.SplitHostPort(c.req.RemoteAddr); err == nil {
-		remoteIp = xffHost
+	if this.cors != nil && isPreflight(c.req) {
+		this.cors.preflight(c)
+		return
 	}
-	c.variables.Set("remote_ip", remoteIp)
-	for k, _ := range c.req.Header {
-		c.variables.Set(fmt.Sprintf("header_%s", k), c.req.Header.Get(k))
+	if this.ret != nil {
+		this.ret.serve(this, c)
+		return
 	}
-	xff := c.req.Header.Get("X-Forward-For")
-	if xff == "" {
-		xff = remoteIp
-	} else {
-		xff += ", " + remoteIp
+	if err := this.servicesBalance(c); err != nil {
+		c.variables.Set("error_message", fmt.Sprintf("select target failed %v", err))
+		c.variables.Set("status", "502")
+		hasError = true
+		Handler502(c.w, c.req)
+		return
+	}
+	if c.target.root != "" {
+		if this.cors != nil {
+			this.cors.process(c.w.Header(), c.req.Header.Get("Origin"))
+		}
+		this.static.serve(c)
+		return
+	}
+	if this.mirror != nil && this.mirror.fork(c) {
+		// 请求体没有被完整读取时，关闭请求体以结束镜像并释放并发数
+		defer c.req.Body.Close()
 	}
-	c.variables.Set("x_forward_for", xff)
-	this.servicesBalance(c)
 
 	if err := this.proxyPass(c); err != nil {
 		c.variables.Set("error_message", fmt.Sprintf("proxy pass failed %v", err))
@@ -217,13 +506,58 @@ func (this *ProxyHandle) serve(c *Context) {
 	}
 }
 
-func (this *ProxyHandle) servicesBalance(c *Context) {
-	this.target.load(c.variables)
-	if _, err := this.target.balance(this.services); err != nil {
+func (this *ProxyHandle) servicesBalance(c *Context) error {
+	target, err := this.selectTarget(c)
+	if err != nil {
+		return err
+	}
+	tar, err := target.resolve(c.variables, this.services)
+	if err != nil {
 		c.variables.Set("error_message", fmt.Sprintf("balance failed %v", err))
 		this.errorLog.Logfmt(c.variables)
 	}
-	c.url = this.target.tar
+	c.url = tar
+	c.target = target
+	return nil
+}
+
+// selectTarget 按照权重选择代理目标
+// 配置了sticky时，使用sticky的值计算hash，相同的值总是选择同一个目标
+func (this *ProxyHandle) selectTarget(c *Context) (*ProxyTarget, error) {
+	if len(this.targets) == 0 || this.totalWeight <= 0 {
+		return nil, fmt.Errorf("rule %s has no target", this.name)
+	}
+	if len(this.targets) == 1 {
+		return this.targets[0], nil
+	}
+	var n int
+	if key := this.stickyKey(c); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(this.totalWeight))
+	} else {
+		n = rand.Intn(this.totalWeight)
+	}
+	for _, target := range this.targets {
+		if n < target.weight {
+			debug("select target", target.src)
+			return target, nil
+		}
+		n -= target.weight
+	}
+	return this.targets[len(this.targets)-1], nil
+}
+
+func (this *ProxyHandle) stickyKey(c *Context) string {
+	if this.sticky == nil {
+		return ""
+	}
+	key, resolved := this.sticky.load(c.variables)
+	if !resolved {
+		// 变量不存在时视为没有sticky
+		return ""
+	}
+	return key
 }
 
 func (this *ProxyHandle) transformRequest(req *http.Request, c *Context) {
@@ -232,6 +566,24 @@ func (this *ProxyHandle) transformRequest(req *http.Request, c *Context) {
 			transform.processRequest(req, c.variables, this.errorLog)
 		}
 	}
+	for _, transform := range this.queryTransforms {
+		transform.processRequest(req, c.variables)
+	}
+	for _, transform := range this.cookieTransforms {
+		if transform.when == "request" {
+			transform.processRequest(req, c.variables)
+		}
+	}
+	if isJsonContentType(req.Header.Get("Content-Type")) {
+		transforms := this.jsonTransformsFor("request", func(condition *ProxyTransformCondition) bool {
+			return condition.matchRequest(req, c.variables)
+		})
+		if len(transforms) > 0 {
+			this.transformRequestBody(req, c, func(body []byte) ([]byte, bool) {
+				return transformJson(transforms, body, c.variables)
+			})
+		}
+	}
 }
 
 func (this *ProxyHandle) proxyPass(c *Context) error {
@@ -244,15 +596,36 @@ func (this *ProxyHandle) proxyPass(c *Context) error {
 		Director: func(req *http.Request) {
 			req.URL.Host = encodeUrl.Host
 			req.URL.Scheme = encodeUrl.Scheme
-			req.URL.Path = encodeUrl.Path
+			// 配置了rewrite且to中没有path时，使用原请求的path
+			if encodeUrl.Path != "" || this.rewrite == nil {
+				req.URL.Path = encodeUrl.Path
+				req.URL.RawPath = encodeUrl.RawPath
+			}
+			// to中有query时，使用to中的query
+			if encodeUrl.RawQuery != "" {
+				req.URL.RawQuery = encodeUrl.RawQuery
+			}
+			if this.rewrite != nil {
+				this.rewrite.apply(req.URL, c.variables)
+			}
 			// 改变Host
-			req.Host = encodeUrl.Host
-			c.variables.Set("real_host", encodeUrl.Host)
+			if this.preserveHost {
+				req.Host = c.req.Host
+			} else {
+				req.Host = encodeUrl.Host
+			}
+			c.variables.Set("real_host", req.Host)
+			setForwardedHeaders(req, c)
 			this.transformRequest(req, c)
+			c.variables.Set("upstream_uri", req.URL.String())
+			c.variables.Set("upstream_addr", req.URL.Host)
+			c.upstreamStartAt = time.Now()
 			debug("proxy request Method:", req.Method, "Url:", req.URL, "Header:", req.Header, "Host:", req.Host)
 		},
 		FlushInterval: 5 * time.Second,
 		ModifyResponse: func(resp *http.Response) error {
+			c.variables.Set("upstream_status", fmt.Sprintf("%d", resp.StatusCode))
+			c.variables.Set("upstream_latency", fmt.Sprintf("%d", time.Since(c.upstreamStartAt).Nanoseconds()/int64(time.Millisecond)))
 			c.variables.Set("status", fmt.Sprintf("%d", resp.StatusCode))
 			for k, _ := range resp.Header {
 				v := resp.Header.Get(k)
@@ -268,22 +641,58 @@ func (this *ProxyHandle) proxyPass(c *Context) error {
 }
 
 func (this *ProxyHandle) transformResponse(resp *http.Response, c *Context) {
+	if this.cors != nil {
+		this.cors.process(resp.Header, c.req.Header.Get("Origin"))
+	}
 	for _, transform := range this.headerTransforms {
 		if transform.when == "response" {
 			transform.processResponse(resp, c.variables, this.errorLog)
 		}
 	}
+	for _, transform := range this.cookieTransforms {
+		if transform.when == "response" {
+			transform.processResponse(resp, c.variables)
+		}
+	}
+	if this.bodyTransform != nil && c.req.Method != http.MethodHead &&
+		this.bodyTransform.matchContentType(resp.Header.Get("Content-Type")) {
+		this.transformResponseBody(resp, c, func(body []byte) ([]byte, bool) {
+			return this.bodyTransform.apply(body, c.variables), true
+		})
+	}
+	if c.req.Method != http.MethodHead && isJsonContentType(resp.Header.Get("Content-Type")) {
+		transforms := this.jsonTransformsFor("response", func(condition *ProxyTransformCondition) bool {
+			return condition.matchResponse(resp, c.variables)
+		})
+		if len(transforms) > 0 {
+			this.transformResponseBody(resp, c, func(body []byte) ([]byte, bool) {
+				return transformJson(transforms, body, c.variables)
+			})
+		}
+	}
 }
 
 type ProxyHandleFilter struct {
+	prefix      string
+	exactPath   string
 	requestURIs []*ProxyHandleFilterRequestURI
+	methods     []string
 	headers     []*ProxyHandleFilterHeader
+	queries     []*ProxyHandleFilterQuery
+	cookies     []*ProxyHandleFilterCookie
+	remoteAddrs []*net.IPNet
 }
 
 func NewProxyHandleFilter(filter *Filter) *ProxyHandleFilter {
 	ret := &ProxyHandleFilter{
+		prefix:      filter.Prefix,
+		exactPath:   filter.ExactPath,
 		requestURIs: []*ProxyHandleFilterRequestURI{},
+		methods:     filter.Methods,
 		headers:     []*ProxyHandleFilterHeader{},
+		queries:     []*ProxyHandleFilterQuery{},
+		cookies:     []*ProxyHandleFilterCookie{},
+		remoteAddrs: []*net.IPNet{},
 	}
 	for _, uri := range filter.RequestURIs {
 		ret.requestURIs = append(ret.requestURIs, NewProxyHandleFilterRequestURI(uri))
@@ -291,10 +700,29 @@ func NewProxyHandleFilter(filter *Filter) *ProxyHandleFilter {
 	for _, header := range filter.Headers {
 		ret.headers = append(ret.headers, NewProxyHandleFilterHeader(header))
 	}
+	for _, query := range filter.Queries {
+		ret.queries = append(ret.queries, NewProxyHandleFilterQuery(query))
+	}
+	for _, cookie := range filter.Cookies {
+		ret.cookies = append(ret.cookies, NewProxyHandleFilterCookie(cookie))
+	}
+	for _, addr := range filter.RemoteAddrs {
+		if ipnet, err := parseCIDR(addr); err == nil {
+			ret.remoteAddrs = append(ret.remoteAddrs, ipnet)
+		}
+	}
 	return ret
 }
 
+// match 各字段之间为“且”，字段内的多个条件之间为“或”，字段为空则不检查
 func (this *ProxyHandleFilter) match(c *Context) (bool, error) {
+	if this.prefix != "" && !strings.HasPrefix(c.req.URL.Path, this.prefix) {
+		return false, nil
+	}
+	if this.exactPath != "" && c.req.URL.Path != this.exactPath {
+		return false, nil
+	}
+
 	match := false
 	if len(this.requestURIs) == 0 {
 		match = true
@@ -304,6 +732,7 @@ func (this *ProxyHandleFilter) match(c *Context) (bool, error) {
 		if is, err := uri.match(c); err != nil {
 			return false, err
 		} else if is {
+			// 不提前退出，多个正则都匹配时$n使用最后一个匹配的结果
 			match = true
 		}
 	}
@@ -311,136 +740,323 @@ func (this *ProxyHandleFilter) match(c *Context) (bool, error) {
 		return false, nil
 	}
 
-	if len(this.headers) == 0 {
-		return true, nil
+	if len(this.methods) > 0 && !this.matchMethod(c) {
+		return false, nil
+	}
+	if len(this.remoteAddrs) > 0 && !this.matchRemoteAddr(c) {
+		return false, nil
 	}
 
-	for _, header := range this.headers {
-		if header.match(c) {
-			return true, nil
+	if len(this.headers) > 0 {
+		match = false
+		for _, header := range this.headers {
+			if header.match(c) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, nil
 		}
 	}
-	return false, nil
+
+	if len(this.queries) > 0 {
+		match = false
+		query := c.req.URL.Query()
+		for _, q := range this.queries {
+			if q.match(c, query) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+
+	if len(this.cookies) > 0 {
+		match = false
+		for _, cookie := range this.cookies {
+			if cookie.match(c) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (this *ProxyHandleFilter) matchMethod(c *Context) bool {
+	for _, method := range this.methods {
+		if strings.EqualFold(method, c.req.Method) {
+			debug("match method", method)
+			return true
+		}
+	}
+	return false
+}
+
+func (this *ProxyHandleFilter) matchRemoteAddr(c *Context) bool {
+	ip := net.ParseIP(c.remoteIp)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range this.remoteAddrs {
+		if ipnet.Contains(ip) {
+			debug("match remote addr", ipnet, c.remoteIp)
+			return true
+		}
+	}
+	return false
 }
 
 type ProxyHandleFilterRequestURI struct {
 	value string
+	re    *regexp.Regexp
 }
 
 func NewProxyHandleFilterRequestURI(value string) *ProxyHandleFilterRequestURI {
-	return &ProxyHandleFilterRequestURI{value: value}
+	return &ProxyHandleFilterRequestURI{value: value, re: regexp.MustCompile(value)}
 }
 
 func (this *ProxyHandleFilterRequestURI) match(c *Context) (bool, error) {
-	re, err := regexp.Compile(this.value)
-	if err != nil {
-		return false, err
-	}
-	ret := re.MatchString(c.req.URL.RequestURI())
+	g := this.re.FindStringSubmatch(c.req.URL.RequestURI())
+	ret := g != nil
 	debug(fmt.Sprintf("match request_uri(%v) %s->%s", ret, this.value, c.req.URL.RequestURI()))
 	if ret {
-		g := re.FindAllStringSubmatch(c.req.URL.RequestURI(), -1)
-		for i, ge := range g[0] {
-			c.variables.Set(fmt.Sprintf("%d", i), ge)
-		}
+		setSubmatchVariables(c.variables, this.re, g, "uri")
 	}
 	return ret, nil
 }
 
 type ProxyHandleFilterHeader struct {
-	key   string
-	value *VariableExpr
+	key     string
+	matcher *ProxyValueMatcher
 }
 
 func NewProxyHandleFilterHeader(header *HeaderFilter) *ProxyHandleFilterHeader {
 	return &ProxyHandleFilterHeader{
-		key:   header.Key,
-		value: NewVariableExpr(header.Value),
+		key:     header.Key,
+		matcher: NewProxyValueMatcher(header.Op, header.Value, "hdr_"+http.CanonicalHeaderKey(header.Key), header.IgnoreCase),
 	}
 }
 
 func (this *ProxyHandleFilterHeader) match(c *Context) bool {
-	ret := strings.EqualFold(this.value.Load(c.variables), c.req.Header.Get(this.key))
-	debug(fmt.Sprintf("match header(%v) %s->%s", ret, this.value.Load(c.variables), c.req.Header.Get(this.key)))
+	ret := this.matcher.match(c.req.Header.Values(this.key), c.variables)
+	debug(fmt.Sprintf("match header(%v) %s %s->%v", ret, this.key, this.matcher.op, c.req.Header.Values(this.key)))
+	return ret
+}
+
+// ProxyValueMatcher 按照op比较一组值，值为多个时(如重复的header)任一值满足即为匹配
+// 其中not_equals和not_exists要求所有值都满足
+// regex匹配到的分组写入以namespace为前缀的变量
+// 所有op都区分大小写，ignoreCase为true时都不区分大小写
+type ProxyValueMatcher struct {
+	op         string
+	value      *VariableExpr
+	re         *regexp.Regexp
+	namespace  string
+	ignoreCase bool
+}
+
+func NewProxyValueMatcher(op, value, namespace string, ignoreCase bool) *ProxyValueMatcher {
+	if op == "" {
+		op = "equals"
+	}
+	ret := &ProxyValueMatcher{
+		op:         op,
+		value:      NewVariableExpr(value),
+		namespace:  namespace,
+		ignoreCase: ignoreCase,
+	}
+	if op == "regex" {
+		if ignoreCase {
+			value = "(?i)" + value
+		}
+		ret.re = regexp.MustCompile(value)
+	}
+	return ret
+}
+
+func (this *ProxyValueMatcher) equal(a, b string) bool {
+	if this.ignoreCase {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func (this *ProxyValueMatcher) hasPrefix(s, prefix string) bool {
+	if this.ignoreCase {
+		return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+	}
+	return strings.HasPrefix(s, prefix)
+}
+
+func (this *ProxyValueMatcher) match(values []string, variables *ProxyVariable) bool {
+	switch this.op {
+	case "exists":
+		return len(values) > 0
+	case "not_exists":
+		return len(values) == 0
+	case "not_equals":
+		value := this.value.Load(variables)
+		for _, v := range values {
+			if this.equal(v, value) {
+				return false
+			}
+		}
+		return true
+	case "equals":
+		value := this.value.Load(variables)
+		for _, v := range values {
+			if this.equal(v, value) {
+				return true
+			}
+		}
+	case "prefix":
+		value := this.value.Load(variables)
+		for _, v := range values {
+			if this.hasPrefix(v, value) {
+				return true
+			}
+		}
+	case "regex":
+		for _, v := range values {
+			if g := this.re.FindStringSubmatch(v); g != nil {
+				setSubmatchVariables(variables, this.re, g, this.namespace)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type ProxyHandleFilterQuery struct {
+	key   string
+	value *VariableExpr
+}
+
+func NewProxyHandleFilterQuery(query *QueryFilter) *ProxyHandleFilterQuery {
+	return &ProxyHandleFilterQuery{
+		key:   query.Key,
+		value: NewVariableExpr(query.Value),
+	}
+}
+
+// match 请求参数中出现多个同名参数时，任一值相等即为匹配
+func (this *ProxyHandleFilterQuery) match(c *Context, query url.Values) bool {
+	value := this.value.Load(c.variables)
+	for _, v := range query[this.key] {
+		if v == value {
+			debug(fmt.Sprintf("match query(true) %s->%s", this.key, value))
+			return true
+		}
+	}
+	debug(fmt.Sprintf("match query(false) %s->%s", this.key, value))
+	return false
+}
+
+type ProxyHandleFilterCookie struct {
+	key   string
+	value *VariableExpr
+}
+
+func NewProxyHandleFilterCookie(cookie *CookieFilter) *ProxyHandleFilterCookie {
+	return &ProxyHandleFilterCookie{
+		key:   cookie.Key,
+		value: NewVariableExpr(cookie.Value),
+	}
+}
+
+func (this *ProxyHandleFilterCookie) match(c *Context) bool {
+	cookie, err := c.req.Cookie(this.key)
+	if err != nil {
+		debug(fmt.Sprintf("match cookie(false) %s not found", this.key))
+		return false
+	}
+	value := this.value.Load(c.variables)
+	ret := cookie.Value == value
+	debug(fmt.Sprintf("match cookie(%v) %s->%s", ret, value, cookie.Value))
 	return ret
 }
 
+// ProxyTarget 代理目标，由所有匹配到该rule的请求共享，创建后不再修改
+// 每个请求解析出的目标地址保存在Context中
 type ProxyTarget struct {
-	src string
-	tar string
+	src    string
+	expr   *VariableExpr
+	weight int
+	root   string
 }
 
-func NewProxyTarget(url string) *ProxyTarget {
-	return &ProxyTarget{src: url, tar: url}
+func NewProxyTarget(url string, weight int) *ProxyTarget {
+	return &ProxyTarget{src: url, expr: NewVariableExpr(url), weight: weight, root: staticRoot(url)}
 }
 
-func (this *ProxyTarget) load(variables *ProxyVariable) {
-	url := NewVariableExpr(this.src)
-	this.tar = url.Load(variables)
-	debug("trans url", this.src, this.tar)
+// resolve 使用当前请求的变量计算目标地址，并通过服务集选择实际请求的host
+// 服务集选择失败时，返回未经服务集处理的地址和错误
+func (this *ProxyTarget) resolve(variables *ProxyVariable, services *ProxyServices) (string, error) {
+	tar := this.expr.Load(variables)
+	debug("trans url", this.src, tar)
+	ret, _, err := this.balance(tar, services)
+	return ret, err
 }
 
-func (this *ProxyTarget) balance(services *ProxyServices) (bool, error) {
+func (this *ProxyTarget) balance(tar string, services *ProxyServices) (string, bool, error) {
 	if services == nil {
 		debug("balance services is nil")
-		return false, nil
+		return tar, false, nil
 	}
-	u, err := url.Parse(this.tar)
+	u, err := url.Parse(tar)
 	if err != nil {
-		debug("balance target url parse error", this.tar)
-		return false, err
+		debug("balance target url parse error", tar)
+		return tar, false, err
 	}
 	if u.Host == "" || strings.ContainsAny(u.Host, ". & :") {
 		debug("balance target is a domain", u)
-		return true, nil
+		return tar, true, nil
 	}
 	if host, ok := services.balanceHost(u.Host); ok {
 		u.Host = host
-		this.tar = u.String()
-		debug("balance success to", this.tar)
-		return true, nil
+		debug("balance success to", u)
+		return u.String(), true, nil
 	}
-	debug("balance failed", this.tar)
-	return false, nil
+	debug("balance failed", tar)
+	return tar, false, nil
 }
 
 type ProxyHeaderTransform struct {
-	when    string
-	method  string
-	key     string
-	value   *VariableExpr
-	pattern string
+	when      string
+	method    string
+	key       string
+	value     *VariableExpr
+	pattern   *regexp.Regexp
+	condition *ProxyTransformCondition
 }
 
 func NewProxyHeaderTransform(headerTransform *HeaderTransform) *ProxyHeaderTransform {
-	return &ProxyHeaderTransform{
-		when:    headerTransform.When,
-		method:  headerTransform.Method,
-		key:     headerTransform.Key,
-		value:   NewVariableExpr(headerTransform.Value),
-		pattern: headerTransform.Pattern,
+	ret := &ProxyHeaderTransform{
+		when:      headerTransform.When,
+		method:    headerTransform.Method,
+		key:       headerTransform.Key,
+		value:     NewVariableExpr(headerTransform.Value),
+		condition: NewProxyTransformCondition(headerTransform.Condition),
+	}
+	if headerTransform.Pattern != "" {
+		ret.pattern = regexp.MustCompile(headerTransform.Pattern)
 	}
+	return ret
 }
 
 func (this *ProxyHeaderTransform) processRequest(r *http.Request, variables *ProxyVariable, errorlog *ProxyLogger) {
-	if this.pattern != "" {
-		if header := r.Header.Get(this.key); header != "" {
-			re, err := regexp.Compile(this.pattern)
-			if err != nil {
-				errorlog.Error(err)
-				return
-			}
-			ret := re.MatchString(header)
-			debug(fmt.Sprintf("match header(%v) %s->%s", ret, this.pattern, header))
-			if ret {
-				g := re.FindAllStringSubmatch(header, -1)
-				for i, ge := range g[0] {
-					variables.Set(fmt.Sprintf("%d", i), ge)
-				}
-			} else {
-				return
-			}
-		}
+	if !this.condition.matchRequest(r, variables) {
+		return
+	}
+	if !matchTransformPattern(this.pattern, r.Header.Get(this.key), variables, "transform_hdr_"+http.CanonicalHeaderKey(this.key)) {
+		return
 	}
 
 	switch this.method {
@@ -459,24 +1075,11 @@ func (this *ProxyHeaderTransform) processRequest(r *http.Request, variables *Pro
 }
 
 func (this *ProxyHeaderTransform) processResponse(r *http.Response, variables *ProxyVariable, errorlog *ProxyLogger) {
-	if this.pattern != "" {
-		if header := r.Header.Get(this.key); header != "" {
-			re, err := regexp.Compile(this.pattern)
-			if err != nil {
-				errorlog.Error(err)
-				return
-			}
-			ret := re.MatchString(header)
-			debug(fmt.Sprintf("match header(%v) %s->%s", ret, this.pattern, header))
-			if ret {
-				g := re.FindAllStringSubmatch(header, -1)
-				for i, ge := range g[0] {
-					variables.Set(fmt.Sprintf("%d", i), ge)
-				}
-			} else {
-				return
-			}
-		}
+	if !this.condition.matchResponse(r, variables) {
+		return
+	}
+	if !matchTransformPattern(this.pattern, r.Header.Get(this.key), variables, "transform_hdr_"+http.CanonicalHeaderKey(this.key)) {
+		return
 	}
 
 	switch this.method {
@@ -493,3 +1096,49 @@ func (this *ProxyHeaderTransform) processResponse(r *http.Response, variables *P
 		r.Header.Del(this.key)
 	}
 }
+
+// setSubmatchVariables 将正则表达式匹配到的分组依次写入变量$0...$n
+// 同时写入带有来源前缀的变量$<namespace>_0...$<namespace>_n，不会被其他正则覆盖
+// 命名分组(?P<name>...)还会写入变量$name
+func setSubmatchVariables(variables *ProxyVariable, re *regexp.Regexp, g []string, namespace string) {
+	for i, ge := range g {
+		variables.Set(fmt.Sprintf("%d", i), ge)
+		variables.Set(fmt.Sprintf("%s_%d", namespace, i), ge)
+	}
+	setNamedSubmatchVariables(variables, re, g)
+}
+
+// reservedCaptureName 返回与内置变量重名的命名分组，没有时返回空字符串
+func reservedCaptureName(re *regexp.Regexp) string {
+	for _, name := range re.SubexpNames() {
+		if name != "" && isReservedVariable(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func setNamedSubmatchVariables(variables *ProxyVariable, re *regexp.Regexp, g []string) {
+	for i, name := range re.SubexpNames() {
+		if name != "" && i < len(g) {
+			variables.Set(name, g[i])
+		}
+	}
+}
+
+// parseCIDR 解析CIDR，单独的ip将被视为只包含该ip的网段
+func parseCIDR(addr string) (*net.IPNet, error) {
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", addr)
+		}
+		if ip.To4() != nil {
+			addr += "/32"
+		} else {
+			addr += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(addr)
+	return ipnet, err
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestRuleCheckNullTarget(t *testing.T) {
+	rule := &Rule{To: RuleTo{nil}}
+	if err := rule.check("rule"); err == nil {
+		t.Error("expect error for null target")
+	}
+}
+
+func TestSelectTargetWithoutTargets(t *testing.T) {
+	handle := NewProxyHandle(&Rule{To: RuleTo{nil}}, NewProxyServices(nil), NewProxyLogger(), NewProxyLogger(), NewProxyLogger())
+	c := NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if _, err := handle.selectTarget(c); err == nil {
+		t.Error("expect error when no target")
+	}
+
+	handle.sticky = NewVariableExpr("$host")
+	c.variables.Set("host", "a")
+	if _, err := handle.selectTarget(c); err == nil {
+		t.Error("expect error when no target with sticky")
+	}
+}
+
+// TestServicesBalanceConcurrent 并发请求共享同一个ProxyTarget时，每个请求都应得到自己的地址
+// 需要使用`go test -race`运行
+func TestServicesBalanceConcurrent(t *testing.T) {
+	services := NewProxyServices([]*Service{{
+		Name:  "backend",
+		Hosts: []*Host{{Host: "10.0.0.1:8080", Weight: 1}, {Host: "10.0.0.2:8080", Weight: 1}},
+	}})
+	defer services.stop()
+	handle := NewProxyHandle(&Rule{To: RuleTo{{To: "http://backend/$1"}}}, services, NewProxyLogger(), NewProxyLogger(), NewProxyLogger())
+
+	const workers = 64
+	const requests = 200
+	var wg sync.WaitGroup
+	errs := make(chan string, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				id := fmt.Sprintf("user%d-%d", i, j)
+				c := NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id, nil))
+				c.variables.Set("1", id)
+				if err := handle.servicesBalance(c); err != nil {
+					errs <- err.Error()
+					return
+				}
+				if c.url != "http://10.0.0.1:8080/"+id && c.url != "http://10.0.0.2:8080/"+id {
+					errs <- fmt.Sprintf("request %s got url %s", id, c.url)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestFilterRequestURIsLastMatchWins(t *testing.T) {
+	filter := NewProxyHandleFilter(&Filter{RequestURIs: []string{"^/(a)/", "^/a/(b)"}})
+	c := NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/a/b", nil))
+	if is, err := filter.match(c); err != nil || !is {
+		t.Fatal("expect match", err)
+	}
+	if ret := NewVariableExpr("$1").Load(c.variables); ret != "b" {
+		t.Errorf("expect $1 from the last matched regexp, got %s", ret)
+	}
+}
+
+func TestReservedCaptureName(t *testing.T) {
+	cases := map[string]string{
+		`^/t/(?P<tenant>\w+)/`:    "",
+		`^/(?P<host>[^/]+)`:       "host",
+		`(?P<remote_ip>.*)`:       "remote_ip",
+		`(?P<header_X>.*)`:        "header_X",
+		`(?P<a>x)(?P<uri_1>.*)`:   "uri_1",
+		`(?P<transform_arg_x>.*)`: "transform_arg_x",
+		`^/(\w+)/(?P<id>\d+)`:     "",
+	}
+	for expr, expect := range cases {
+		if got := reservedCaptureName(regexp.MustCompile(expr)); got != expect {
+			t.Errorf("%s: expect %q, got %q", expr, expect, got)
+		}
+	}
+}
+
+func TestCaptureNamespaces(t *testing.T) {
+	filter := NewProxyHandleFilter(&Filter{Headers: []*HeaderFilter{{Key: "x-canary", Op: "regex", Value: "^v(\\d+)$"}}})
+	req := httptest.NewRequest("GET", "/?id=1&id_1=x", nil)
+	req.Header.Set("X-Canary", "v3")
+	req.Header.Set("Cookie", "sid=s1")
+	c := NewContext(httptest.NewRecorder(), req)
+	if is, err := filter.match(c); err != nil || !is {
+		t.Fatal("expect match", err)
+	}
+	c.variables.Set("arg_id_1", "x")
+	NewProxyHeaderTransform(&HeaderTransform{When: "request", Method: "set", Key: "x-canary", Pattern: "^(v)"}).processRequest(req, c.variables, NewProxyLogger())
+	NewProxyQueryTransform(&QueryTransform{When: "request", Method: "set", Key: "id", Pattern: "^(\\d)$"}).processRequest(req, c.variables)
+	NewProxyCookieTransform(&CookieTransform{When: "request", Method: "set", Key: "sid", Pattern: "^s(\\d)$"}).processRequest(req, c.variables)
+	cases := map[string]string{
+		"$hdr_X-Canary_1":           "3",
+		"$hdr_x-canary_1":           "3",
+		"$transform_hdr_x-canary_1": "v",
+		"$arg_id_1":                 "x",
+		"$transform_arg_id_1":       "1",
+		"$transform_cookie_sid_1":   "1",
+	}
+	for expr, expect := range cases {
+		if got := NewVariableExpr(expr).Load(c.variables); got != expect {
+			t.Errorf("%s: expect %q, got %q", expr, expect, got)
+		}
+	}
+}
+
+func TestProxyValueMatcherCase(t *testing.T) {
+	cases := []struct {
+		op         string
+		value      string
+		ignoreCase bool
+		values     []string
+		expect     bool
+	}{
+		{"equals", "Beta", false, []string{"beta"}, false},
+		{"equals", "Beta", false, []string{"x", "Beta"}, true},
+		{"equals", "Beta", true, []string{"beta"}, true},
+		{"not_equals", "Beta", false, []string{"beta"}, true},
+		{"not_equals", "Beta", true, []string{"beta"}, false},
+		{"prefix", "Mozilla", false, []string{"mozilla/5.0"}, false},
+		{"prefix", "Mozilla", true, []string{"mozilla/5.0"}, true},
+		{"prefix", "Mozilla", true, []string{"moz"}, false},
+		{"regex", "^Beta$", false, []string{"beta"}, false},
+		{"regex", "^Beta$", true, []string{"beta"}, true},
+	}
+	for _, tc := range cases {
+		matcher := NewProxyValueMatcher(tc.op, tc.value, "hdr_X", tc.ignoreCase)
+		if got := matcher.match(tc.values, NewProxyVariable()); got != tc.expect {
+			t.Errorf("%s %s ignore_case=%v %v: expect %v", tc.op, tc.value, tc.ignoreCase, tc.values, tc.expect)
+		}
+	}
+}
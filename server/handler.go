@@ -15,3 +15,9 @@ func Handler500(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Proxy-Error-Status", "500")
 	w.WriteHeader(500)
 }
+
+func Handler502(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+	w.Header().Set("Proxy-Error-Status", "502")
+	w.WriteHeader(502)
+}
@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,6 +25,9 @@ type HttpServer struct {
 	services *ProxyServices
 	logfmts  *ProxyLogfmts
 
+	trustedProxies *ProxyTrustedProxies
+	realIp         string
+
 	reloadHandles  *ProxyHandles
 	reloadServices *ProxyServices
 }
@@ -30,16 +38,23 @@ func (this *HttpServer) run() {
 		Handler:        this,
 		MaxHeaderBytes: 0x10000,
 	}
+	ln, err := net.Listen("tcp", this.server.Addr)
+	if err != nil {
+		this.logger.Error(err)
+		return
+	}
+	// 是否解析PROXY protocol在每个连接建立时判断，reload后立即生效
+	ln = &proxyProtocolListener{Listener: ln, server: this}
 	if this.certFile != "" && this.keyFile != "" {
 		this.logger.Log(fmt.Sprintf("https server listen on %d with %s and %s", this.port, this.certFile, this.keyFile))
-		if err := this.server.ListenAndServeTLS(this.certFile, this.keyFile); err != nil {
+		if err := this.server.ServeTLS(ln, this.certFile, this.keyFile); err != nil {
 			this.logger.Error(err)
 		} else {
 			this.logger.Error(fmt.Sprintf("https server on %d donw"), this.port)
 		}
 	} else {
 		this.logger.Log(fmt.Sprintf("http server listen on %d", this.port))
-		if err := this.server.ListenAndServe(); err != nil {
+		if err := this.server.Serve(ln); err != nil {
 			this.logger.Error(err)
 		} else {
 			this.logger.Error(fmt.Sprintf("https server on %d donw"), this.port)
@@ -73,6 +88,8 @@ func (this *HttpServer) startReload() {
 	this.reloadServices = this.services
 	this.services = nil
 	this.logfmts = nil
+	this.trustedProxies = nil
+	this.realIp = ""
 }
 
 func (this *HttpServer) endReload() {
@@ -92,6 +109,19 @@ func (this *HttpServer) appendApp(app *App) {
 	this.certFile = app.CertFile
 	this.keyFile = app.KeyFile
 
+	// 可信代理对整个端口生效
+	if this.trustedProxies == nil {
+		this.trustedProxies = NewProxyTrustedProxies()
+	}
+	this.trustedProxies.add(app.TrustedProxies)
+	if app.RealIp != "" {
+		if this.realIp != "" && this.realIp != app.RealIp {
+			this.logger.Error(fmt.Sprintf("conflict real_ip %s on port %d, use %s", app.RealIp, this.port, this.realIp))
+		} else {
+			this.realIp = app.RealIp
+		}
+	}
+
 	// 其他属性可以按app独享
 	if this.handles == nil {
 		this.handles = NewProxyHandles(this.logger)
@@ -113,6 +143,20 @@ func (this *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	c := NewContext(w, req)
 	c.startAt = time.Now()
 	c.variables.Set("request_start", c.startAt.Format("2006/01/02 15:04:05"))
+	c.variables.Set("request_start_msec", fmt.Sprintf("%d", c.startAt.UnixNano()/int64(time.Millisecond)))
+	c.variables.Set("request_start_iso8601", c.startAt.Format("2006-01-02T15:04:05.000Z07:00"))
+	c.variables.Set("request_id", newRequestId())
+	c.variables.Set("server_port", fmt.Sprintf("%d", this.port))
+	c.variables.Set("http_version", c.req.Proto)
+	if c.req.TLS != nil {
+		c.variables.Set("scheme", "https")
+		c.variables.Set("tls_version", tlsVersionName(c.req.TLS.Version))
+		c.variables.Set("tls_cipher", tls.CipherSuiteName(c.req.TLS.CipherSuite))
+		c.variables.Set("sni", c.req.TLS.ServerName)
+	} else {
+		c.variables.Set("scheme", "http")
+	}
+	c.countBody()
 
 	c.variables.Set("method", c.req.Method)
 	c.variables.Set("host", c.req.Host)
@@ -120,11 +164,59 @@ func (this *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	c.variables.Set("uri_query", c.req.URL.RawQuery)
 	c.variables.Set("request_uri", c.req.RequestURI)
 
+	c.peerIp = remoteAddrIp(c.req.RemoteAddr)
+	c.trusted = this.trustedProxies.contains(c.peerIp)
+	c.remoteIp = this.trustedProxies.realClientIp(c.req, c.peerIp, this.realIp)
+	c.variables.Set("remote_ip", c.remoteIp)
+	c.variables.Set("client_ip", c.remoteIp)
+	for k, _ := range c.req.Header {
+		c.variables.Set(fmt.Sprintf("header_%s", k), c.req.Header.Get(k))
+	}
+	for _, cookie := range c.req.Cookies() {
+		c.variables.Set(fmt.Sprintf("cookie_%s", cookie.Name), cookie.Value)
+	}
+	for k, v := range c.req.URL.Query() {
+		c.variables.Set(fmt.Sprintf("arg_%s", k), v[0])
+	}
+	if c.trusted {
+		c.forwardedFor = strings.Join(c.req.Header.Values("X-Forwarded-For"), ", ")
+	}
+	xff := c.forwardedFor
+	if xff == "" {
+		xff = c.peerIp
+	} else {
+		xff += ", " + c.peerIp
+	}
+	c.variables.Set("x_forward_for", xff)
+
 	handle, exist := this.handles.match(c)
 	if !exist {
 		debug("can not find match handle")
-		Handler404(w, req)
+		this.handles.notFound(c)
 		return
 	}
 	handle.serve(c)
 }
+
+// newRequestId 生成随机的请求id，32位十六进制字符
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
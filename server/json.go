@@ -0,0 +1,242 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// ProxyJsonTransform 按照JSON Pointer(RFC 6901)修改json格式的请求体或响应体
+type ProxyJsonTransform struct {
+	when      string
+	method    string
+	pointer   []string
+	to        []string
+	value     *VariableExpr
+	raw       bool
+	condition *ProxyTransformCondition
+}
+
+func NewProxyJsonTransform(jsonTransform *JsonTransform) *ProxyJsonTransform {
+	return &ProxyJsonTransform{
+		when:    jsonTransform.When,
+		method:  jsonTransform.Method,
+		pointer: parseJsonPointer(jsonTransform.Pointer),
+		to:      parseJsonPointer(jsonTransform.To),
+		value:   NewVariableExpr(jsonTransform.Value),
+		raw:     jsonTransform.Type == "json",
+
+		condition: NewProxyTransformCondition(jsonTransform.Condition),
+	}
+}
+
+// parseJsonPointer 将`/a/b~1c`解析为["a", "b/c"]
+func parseJsonPointer(pointer string) []string {
+	if pointer == "" {
+		return nil
+	}
+	ret := strings.Split(pointer[1:], "/")
+	for i, token := range ret {
+		ret[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return ret
+}
+
+// apply 执行修改，返回修改后的文档以及是否有修改
+func (this *ProxyJsonTransform) apply(doc interface{}, variables *ProxyVariable) (interface{}, bool, error) {
+	switch this.method {
+	case "set":
+		var value interface{} = this.value.Load(variables)
+		if this.raw {
+			if err := json.Unmarshal([]byte(value.(string)), &value); err != nil {
+				return doc, false, fmt.Errorf("invalid json value %v", err)
+			}
+		}
+		doc, err := jsonSet(doc, this.pointer, value)
+		return doc, err == nil, err
+	case "del":
+		doc, ok := jsonDelete(doc, this.pointer)
+		return doc, ok, nil
+	case "rename":
+		// 先设置到to，成功后再删除pointer，避免设置失败时丢失数据
+		if jsonPointerOverlap(this.pointer, this.to) {
+			return doc, false, fmt.Errorf("rename pointer overlaps with to")
+		}
+		value, ok := jsonGet(doc, this.pointer)
+		if !ok {
+			return doc, false, nil
+		}
+		doc, err := jsonSet(doc, this.to, value)
+		if err != nil {
+			return doc, false, err
+		}
+		doc, _ = jsonDelete(doc, this.pointer)
+		return doc, true, nil
+	}
+	return doc, false, nil
+}
+
+// jsonPointerOverlap 判断两个pointer是否相同或互相包含
+func jsonPointerOverlap(a, b []string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// transformJson 依次执行json修改，body不是合法的json或没有任何修改时返回原body
+func transformJson(transforms []*ProxyJsonTransform, body []byte, variables *ProxyVariable) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		debug("skip json transform for invalid json", err)
+		return body, false
+	}
+	changed := false
+	for _, transform := range transforms {
+		var applied bool
+		var err error
+		if doc, applied, err = transform.apply(doc, variables); err != nil {
+			debug("json transform failed", transform.method, transform.pointer, err)
+		}
+		changed = changed || applied
+	}
+	if !changed {
+		return body, false
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return body, false
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true
+}
+
+// jsonTransformsFor 返回when阶段满足执行条件的json修改
+func (this *ProxyHandle) jsonTransformsFor(when string, match func(*ProxyTransformCondition) bool) []*ProxyJsonTransform {
+	ret := []*ProxyJsonTransform{}
+	for _, transform := range this.jsonTransforms {
+		if transform.when == when && match(transform.condition) {
+			ret = append(ret, transform)
+		}
+	}
+	return ret
+}
+
+func jsonGet(doc interface{}, pointer []string) (interface{}, bool) {
+	for _, token := range pointer {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonSet 设置pointer指向的值，不存在的上级对象会被创建，数组下标为`-`时追加到末尾
+func jsonSet(doc interface{}, pointer []string, value interface{}) (interface{}, error) {
+	if len(pointer) == 0 {
+		return value, nil
+	}
+	token := pointer[0]
+	switch node := doc.(type) {
+	case nil:
+		child, err := jsonSet(nil, pointer[1:], value)
+		if err != nil {
+			return doc, err
+		}
+		return map[string]interface{}{token: child}, nil
+	case map[string]interface{}:
+		child, err := jsonSet(node[token], pointer[1:], value)
+		if err != nil {
+			return doc, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		if token == "-" {
+			child, err := jsonSet(nil, pointer[1:], value)
+			if err != nil {
+				return doc, err
+			}
+			return append(node, child), nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(node) {
+			return doc, fmt.Errorf("invalid array index %s", token)
+		}
+		child, err := jsonSet(node[i], pointer[1:], value)
+		if err != nil {
+			return doc, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return doc, fmt.Errorf("can not set %s on non-container value", token)
+}
+
+// jsonDelete 删除pointer指向的值，不存在时返回false
+func jsonDelete(doc interface{}, pointer []string) (interface{}, bool) {
+	if len(pointer) == 0 {
+		return doc, false
+	}
+	token := pointer[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(pointer) == 1 {
+			_, ok := node[token]
+			delete(node, token)
+			return node, ok
+		}
+		child, ok := jsonDelete(node[token], pointer[1:])
+		if ok {
+			node[token] = child
+		}
+		return node, ok
+	case []interface{}:
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(node) {
+			return doc, false
+		}
+		if len(pointer) == 1 {
+			return append(node[:i], node[i+1:]...), true
+		}
+		child, ok := jsonDelete(node[i], pointer[1:])
+		if ok {
+			node[i] = child
+		}
+		return node, ok
+	}
+	return doc, false
+}
+
+// isJsonContentType application/json或以+json结尾的Content-Type
+func isJsonContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJsonPointer(t *testing.T) {
+	cases := map[string][]string{
+		"":          nil,
+		"/a":        {"a"},
+		"/a/0/b":    {"a", "0", "b"},
+		"/a~1b/c~0": {"a/b", "c~"},
+		"/":         {""},
+	}
+	for pointer, expect := range cases {
+		if got := parseJsonPointer(pointer); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expect %v, got %v", pointer, expect, got)
+		}
+	}
+}
+
+func TestTransformJson(t *testing.T) {
+	variables := NewProxyVariable()
+	variables.Set("tenant", "acme")
+	cases := []struct {
+		transforms []*JsonTransform
+		body       string
+		expect     string
+		changed    bool
+	}{
+		{[]*JsonTransform{{Method: "set", Pointer: "/tenant", Value: "$tenant"}}, `{"a":1}`, `{"a":1,"tenant":"acme"}`, true},
+		{[]*JsonTransform{{Method: "set", Pointer: "/meta/n", Value: "1", Type: "json"}}, `{}`, `{"meta":{"n":1}}`, true},
+		{[]*JsonTransform{{Method: "set", Pointer: "/items/-", Value: "c"}}, `{"items":["a","b"]}`, `{"items":["a","b","c"]}`, true},
+		{[]*JsonTransform{{Method: "del", Pointer: "/internal"}}, `{"a":1,"internal":true}`, `{"a":1}`, true},
+		{[]*JsonTransform{{Method: "del", Pointer: "/items/0"}}, `{"items":[1,2]}`, `{"items":[2]}`, true},
+		{[]*JsonTransform{{Method: "rename", Pointer: "/a", To: "/b"}}, `{"a":1}`, `{"b":1}`, true},
+		{[]*JsonTransform{{Method: "set", Pointer: "/n", Value: "1.50", Type: "json"}}, `{"big":12345678901234567890}`, `{"big":12345678901234567890,"n":1.5}`, true},
+		// 没有任何修改时返回原body
+		{[]*JsonTransform{{Method: "del", Pointer: "/missing"}}, `{"b": 1, "a": 2}`, `{"b": 1, "a": 2}`, false},
+		{[]*JsonTransform{{Method: "rename", Pointer: "/missing", To: "/b"}}, `{"a":1}`, `{"a":1}`, false},
+		// to无法设置时保留原值
+		{[]*JsonTransform{{Method: "rename", Pointer: "/a", To: "/s/x"}}, `{"a":1,"s":"str"}`, `{"a":1,"s":"str"}`, false},
+		{[]*JsonTransform{{Method: "rename", Pointer: "/a", To: "/a/b"}}, `{"a":{"c":1}}`, `{"a":{"c":1}}`, false},
+		{[]*JsonTransform{{Method: "set", Pointer: "/a", Value: "{", Type: "json"}}, `{"a":1}`, `{"a":1}`, false},
+		{[]*JsonTransform{{Method: "set", Pointer: "/a", Value: "1"}}, `not json`, `not json`, false},
+	}
+	for i, tc := range cases {
+		transforms := []*ProxyJsonTransform{}
+		for _, transform := range tc.transforms {
+			transforms = append(transforms, NewProxyJsonTransform(transform))
+		}
+		body, changed := transformJson(transforms, []byte(tc.body), variables)
+		if string(body) != tc.expect || changed != tc.changed {
+			t.Errorf("case %d: expect %s(%v), got %s(%v)", i, tc.expect, tc.changed, body, changed)
+		}
+	}
+}
@@ -16,7 +16,7 @@ type ProxyLogger struct {
 	logger  *log.Logger
 
 	fmt   string
-	lines []string
+	lines []*VariableExpr
 
 	rotateTime   string
 	rotateSize   int64
@@ -28,7 +28,7 @@ type ProxyLogger struct {
 func NewProxyLogger() *ProxyLogger {
 	return &ProxyLogger{
 		logger: log.New(os.Stdout, "", 0),
-		lines:  []string{},
+		lines:  []*VariableExpr{},
 	}
 }
 
@@ -83,12 +83,15 @@ func (this *ProxyLogger) LoadFmt(fmts *ProxyLogfmts) (*ProxyLogger, error) {
 	defer this.unlock()
 	if lines, exist := fmts.find(this.fmt); !exist {
 		if this.fmt == "default" {
-			this.lines = []string{"[WARN] default logfmt is not define"}
+			this.lines = []*VariableExpr{NewVariableExpr("[WARN] default logfmt is not define")}
 			return this, fmt.Errorf("can not find log fmt %s\n", this.fmt)
 		}
 		return nil, fmt.Errorf("can not find log fmt %s\n", this.fmt)
 	} else {
-		this.lines = lines
+		this.lines = []*VariableExpr{}
+		for _, line := range lines {
+			this.lines = append(this.lines, NewVariableExpr(line))
+		}
 	}
 	debug("load fmt success", this.fmt)
 	return this, nil
@@ -112,7 +115,7 @@ func (this *ProxyLogger) Logfmt(variables *ProxyVariable) {
 	this.lock()
 	defer this.unlock()
 	for _, line := range this.lines {
-		this.logger.Println(NewVariableExpr(line).Load(variables))
+		this.logger.Println(line.Load(variables))
 	}
 	this.checkRotate()
 }
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ProxyMirror 将匹配到的请求复制一份发送到其他目标，返回结果将被丢弃
+// 镜像请求在后台发送，不影响主请求的处理
+type ProxyMirror struct {
+	to          string
+	target      *ProxyTarget
+	sample      int
+	maxBodySize int64
+	sem         chan struct{}
+	services    *ProxyServices
+	client      *http.Client
+	errorLog    *ProxyLogger
+	ownLog      bool
+}
+
+func NewProxyMirror(mirror *Mirror, services *ProxyServices, errorLog *ProxyLogger, ownLog bool) *ProxyMirror {
+	ret := &ProxyMirror{
+		to:          mirror.To,
+		target:      NewProxyTarget(mirror.To, 1),
+		sample:      mirror.Sample,
+		maxBodySize: mirror.MaxBodySize,
+		services:    services,
+		errorLog:    errorLog,
+		ownLog:      ownLog,
+	}
+	if ret.sample <= 0 {
+		ret.sample = 100
+		debug("set mirror sample default 100%")
+	}
+	if ret.maxBodySize <= 0 {
+		ret.maxBodySize = 1 << 20
+		debug("set mirror max body size default 1MB")
+	}
+	concurrency := mirror.Concurrency
+	if concurrency <= 0 {
+		concurrency = 100
+		debug("set mirror concurrency default 100")
+	}
+	ret.sem = make(chan struct{}, concurrency)
+	timeout := mirror.Timeout
+	if timeout <= 0 {
+		timeout = 10
+		debug("set mirror timeout default 10s")
+	}
+	ret.client = &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return ret
+}
+
+func (this *ProxyMirror) stop() {
+	if this.ownLog {
+		this.errorLog.Close()
+	}
+}
+
+// fork 复制当前请求并在后台发送
+// 请求体在主请求读取时复制，读取完毕后才发送镜像请求，超过maxBodySize或没有读取完毕时不发送
+// 进行中的镜像请求达到上限时直接丢弃
+// 返回true表示请求体已被替换，调用方需要保证请求体最终被关闭
+func (this *ProxyMirror) fork(c *Context) bool {
+	if this.sample < 100 && rand.Intn(100) >= this.sample {
+		return false
+	}
+	hasBody := c.req.Body != nil && c.req.Body != http.NoBody
+	if hasBody && c.req.ContentLength > this.maxBodySize {
+		debug("mirror skip large body", c.req.ContentLength)
+		return false
+	}
+	select {
+	case this.sem <- struct{}{}:
+	default:
+		debug("mirror skip for too many requests", this.to)
+		return false
+	}
+
+	req, err := this.newRequest(c)
+	if err != nil {
+		this.errorLog.Error(err)
+		this.release()
+		return false
+	}
+	if !hasBody {
+		go this.send(req, nil)
+		return false
+	}
+	c.req.Body = &mirrorBody{
+		body:  c.req.Body,
+		limit: this.maxBodySize,
+		done: func(body []byte, complete bool) {
+			if !complete {
+				debug("mirror skip incomplete or large body", req.URL)
+				this.release()
+				return
+			}
+			go this.send(req, body)
+		},
+	}
+	return true
+}
+
+func (this *ProxyMirror) newRequest(c *Context) (*http.Request, error) {
+	tar, err := this.target.resolve(c.variables, this.services)
+	if err != nil {
+		return nil, fmt.Errorf("mirror balance failed %s %v", this.to, err)
+	}
+	u, err := url.Parse(tar)
+	if err != nil {
+		return nil, fmt.Errorf("mirror target invalid %s %v", tar, err)
+	}
+	u.RawQuery = c.req.URL.RawQuery
+	req, err := http.NewRequest(c.req.Method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("mirror create request failed %s %v", u, err)
+	}
+	req.Header = c.req.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	return req, nil
+}
+
+func (this *ProxyMirror) release() {
+	<-this.sem
+}
+
+func (this *ProxyMirror) send(req *http.Request, body []byte) {
+	defer this.release()
+	if len(body) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	debug("mirror request", req.Method, req.URL)
+	resp, err := this.client.Do(req)
+	if err != nil {
+		this.errorLog.Error("mirror request failed", req.Method, req.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		this.errorLog.Error(fmt.Sprintf("mirror request %s %s response %d", req.Method, req.URL, resp.StatusCode))
+	}
+}
+
+// mirrorBody 在主请求读取请求体时复制一份，读取到EOF或关闭时调用done
+// complete为false表示请求体没有读取完毕或超过了limit
+type mirrorBody struct {
+	mux      sync.Mutex
+	body     io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	finished bool
+	done     func(body []byte, complete bool)
+}
+
+func (this *mirrorBody) Read(p []byte) (int, error) {
+	n, err := this.body.Read(p)
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if n > 0 && !this.overflow && !this.finished {
+		if int64(this.buf.Len()+n) > this.limit {
+			this.overflow = true
+			this.buf.Reset()
+		} else {
+			this.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		this.finish(!this.overflow)
+	}
+	return n, err
+}
+
+func (this *mirrorBody) Close() error {
+	this.mux.Lock()
+	this.finish(false)
+	this.mux.Unlock()
+	return this.body.Close()
+}
+
+func (this *mirrorBody) finish(complete bool) {
+	if this.finished {
+		return
+	}
+	this.finished = true
+	this.done(this.buf.Bytes(), complete)
+}
+
+// hopHeaders 逐跳header，不转发给镜像目标
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMirrorBody(t *testing.T) {
+	cases := []struct {
+		body     string
+		limit    int64
+		readAll  bool
+		complete bool
+	}{
+		{"hello world", 1024, true, true},
+		{"hello world", 5, true, false},
+		{"hello world", 1024, false, false},
+	}
+	for i, tc := range cases {
+		var got string
+		var complete, called bool
+		body := &mirrorBody{
+			body:  ioutil.NopCloser(strings.NewReader(tc.body)),
+			limit: tc.limit,
+			done: func(b []byte, c bool) {
+				if called {
+					t.Errorf("case %d: done called twice", i)
+				}
+				called, got, complete = true, string(b), c
+			},
+		}
+		if tc.readAll {
+			if b, _ := ioutil.ReadAll(body); string(b) != tc.body {
+				t.Errorf("case %d: primary body changed %q", i, b)
+			}
+		} else {
+			io.CopyN(ioutil.Discard, body, 3)
+		}
+		body.Close()
+		if !called || complete != tc.complete || (complete && got != tc.body) {
+			t.Errorf("case %d: got %q complete=%v called=%v", i, got, complete, called)
+		}
+	}
+}
+
+func TestMirrorConcurrencyLimit(t *testing.T) {
+	mirror := NewProxyMirror(&Mirror{To: "http://127.0.0.1:1", Concurrency: 1}, nil, NewProxyLogger(), false)
+	mirror.sem <- struct{}{}
+	c := NewContext(nil, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	body := c.req.Body
+	mirror.fork(c)
+	if c.req.Body != body {
+		t.Error("mirror should be dropped when concurrency limit is reached")
+	}
+}
+
+func TestMirrorReleaseWithoutProxyPass(t *testing.T) {
+	rules := map[string]*Rule{
+		"return": {Return: &Return{Status: 204}},
+		"static": {To: RuleTo{{To: "file://" + t.TempDir() + "/$path"}}},
+	}
+	for name, rule := range rules {
+		rule.Mirror = &Mirror{To: "http://127.0.0.1:1", Concurrency: 2}
+		handle := NewProxyHandle(rule, NewProxyServices(nil), NewProxyLogger(), NewProxyLogger(), NewProxyLogger())
+		handle.mirror = NewProxyMirror(rule.Mirror, nil, NewProxyLogger(), false)
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest("POST", "/index.html", strings.NewReader("body"))
+			// 与net/http一致，只关闭原始的请求体
+			body := req.Body
+			c := NewContext(httptest.NewRecorder(), req)
+			c.variables.Set("path", "index.html")
+			handle.serve(c)
+			body.Close()
+		}
+		if n := len(handle.mirror.sem); n != 0 {
+			t.Errorf("%s: mirror semaphore not released %d", name, n)
+		}
+	}
+}
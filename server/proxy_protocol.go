@@ -0,0 +1,162 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolTimeout 读取PROXY protocol头的超时时间
+const proxyProtocolTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener 解析来自可信代理的连接上的PROXY protocol(v1和v2)头
+// 连接的RemoteAddr会被替换为PROXY protocol头中的来源地址
+type proxyProtocolListener struct {
+	net.Listener
+	server *HttpServer
+}
+
+func (this *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	this.server.mux.RLock()
+	enabled := this.server.realIp == _REAL_IP_PROXY_PROTOCOL
+	trusted := this.server.trustedProxies.contains(remoteAddrIp(conn.RemoteAddr().String()))
+	this.server.mux.RUnlock()
+	if !enabled || !trusted {
+		// 不可信的连接不解析PROXY protocol头，其请求将因格式错误而被拒绝
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// proxyProtocolConn 在第一次读取或获取RemoteAddr时解析PROXY protocol头
+// 解析在连接自己的goroutine中进行，不会阻塞Accept
+type proxyProtocolConn struct {
+	net.Conn
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (this *proxyProtocolConn) init() {
+	this.once.Do(func() {
+		this.reader = bufio.NewReader(this.Conn)
+		this.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		this.remoteAddr, this.err = readProxyProtocolHeader(this.reader)
+		this.Conn.SetReadDeadline(time.Time{})
+		if this.err != nil {
+			debug("read proxy protocol header failed", this.Conn.RemoteAddr(), this.err)
+		}
+	})
+}
+
+func (this *proxyProtocolConn) Read(b []byte) (int, error) {
+	this.init()
+	if this.err != nil {
+		return 0, this.err
+	}
+	return this.reader.Read(b)
+}
+
+func (this *proxyProtocolConn) RemoteAddr() net.Addr {
+	this.init()
+	if this.remoteAddr != nil {
+		return this.remoteAddr
+	}
+	return this.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader 读取PROXY protocol头，返回来源地址
+// UNKNOWN和LOCAL类型的头返回nil，表示使用连接本身的地址
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyProtocolV1(r)
+	case '\r':
+		return readProxyProtocolV2(r)
+	}
+	return nil, errors.New("missing proxy protocol header")
+}
+
+// readProxyProtocolV1 如：`PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n`
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return nil, errors.New("invalid proxy protocol v2 header")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL命令为代理自身的健康检查等连接
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, errors.New("invalid proxy protocol v2 ipv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, errors.New("invalid proxy protocol v2 ipv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyProtocolV2Header(command, family byte, payload []byte) string {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...), 0xdc, 0x04, 0x01, 0xbb)
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	cases := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", true},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", true},
+		{"PROXY TCP4 bad 198.51.100.1 56324 443\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{proxyProtocolV2Header(1, 0x11, ipv4), "192.0.2.1:56324", false},
+		{proxyProtocolV2Header(1, 0x21, ipv6), "[2001:db8::1]:56324", false},
+		{proxyProtocolV2Header(0, 0x00, nil), "", false},
+		{proxyProtocolV2Header(1, 0x00, nil), "", false},
+		{proxyProtocolV2Header(1, 0x11, ipv4[:8]), "", true},
+		{proxyProtocolV2Header(1, 0x21, ipv6[:20]), "", true},
+		{"\r\n\r\n\x00\r\nQUIT\x0a\x11\x11\x00\x00", "", true},
+		{"\r\n\r\nbad\r\nQUIT\n\x21\x11\x00\x00", "", true},
+	}
+	for i, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyProtocolHeader(r)
+		if c.err {
+			if err == nil {
+				t.Errorf("case %d: expect error, got %v", i, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: unexpected error %v", i, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.addr {
+			t.Errorf("case %d: expect %q, got %q", i, c.addr, got)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("case %d: unexpected rest %q", i, rest)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"sort"
+)
+
+// ProxyRuleIndex 基于radix tree的rule索引
+// 所有filter都配置了prefix或exact_path的rule会被加入索引，其他rule每次都需要检查
+// 查找结果按照rule的原始顺序返回，保证匹配优先级与逐条检查时一致
+type ProxyRuleIndex struct {
+	root      *radixNode
+	unindexed []int
+}
+
+func NewProxyRuleIndex(rules []*ProxyHandle) *ProxyRuleIndex {
+	ret := &ProxyRuleIndex{
+		root:      &radixNode{},
+		unindexed: []int{},
+	}
+	for i, rule := range rules {
+		if !rule.indexable() {
+			ret.unindexed = append(ret.unindexed, i)
+			continue
+		}
+		for _, filter := range rule.filters {
+			if filter.exactPath != "" {
+				ret.root.insert(filter.exactPath, i, true)
+			} else {
+				ret.root.insert(filter.prefix, i, false)
+			}
+		}
+	}
+	return ret
+}
+
+// candidates 返回可能匹配当前path的rule下标，按升序排列
+func (this *ProxyRuleIndex) candidates(path string) []int {
+	ret := append([]int{}, this.unindexed...)
+	this.root.lookup(path, func(index int) {
+		ret = append(ret, index)
+	})
+	sort.Ints(ret)
+	// 同一个rule可能通过多个filter被找到，这里去重
+	n := 0
+	for i, index := range ret {
+		if i == 0 || index != ret[n-1] {
+			ret[n] = index
+			n++
+		}
+	}
+	return ret[:n]
+}
+
+type radixNode struct {
+	prefix   string
+	children []*radixNode
+	prefixes []int
+	exacts   []int
+}
+
+func (this *radixNode) insert(key string, index int, exact bool) {
+	node := this
+	for key != "" {
+		var child *radixNode
+		for _, ch := range node.children {
+			if ch.prefix[0] == key[0] {
+				child = ch
+				break
+			}
+		}
+		if child == nil {
+			child = &radixNode{prefix: key}
+			node.children = append(node.children, child)
+			node = child
+			break
+		}
+		l := commonPrefixLength(child.prefix, key)
+		if l < len(child.prefix) {
+			// 拆分节点
+			split := &radixNode{
+				prefix:   child.prefix[l:],
+				children: child.children,
+				prefixes: child.prefixes,
+				exacts:   child.exacts,
+			}
+			child.prefix = child.prefix[:l]
+			child.children = []*radixNode{split}
+			child.prefixes = nil
+			child.exacts = nil
+		}
+		node = child
+		key = key[l:]
+	}
+	if exact {
+		node.exacts = append(node.exacts, index)
+	} else {
+		node.prefixes = append(node.prefixes, index)
+	}
+}
+
+// lookup 查找所有为path前缀的prefix，以及与path完全相同的exact_path
+func (this *radixNode) lookup(path string, fn func(int)) {
+	node := this
+	for {
+		for _, index := range node.prefixes {
+			fn(index)
+		}
+		if path == "" {
+			for _, index := range node.exacts {
+				fn(index)
+			}
+			return
+		}
+		var next *radixNode
+		for _, ch := range node.children {
+			if len(ch.prefix) <= len(path) && path[:len(ch.prefix)] == ch.prefix {
+				next = ch
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		path = path[len(next.prefix):]
+		node = next
+	}
+}
+
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProxyRuleIndexCandidates(t *testing.T) {
+	filters := [][]*Filter{
+		{{Prefix: "/api"}},
+		{{ExactPath: "/api/users"}},
+		{{Prefix: "/api/users"}, {Prefix: "/apix"}},
+		nil,
+		{{Prefix: "/"}},
+		{{RequestURIs: []string{"^/static"}}},
+		{{ExactPath: "/api"}},
+		{{Prefix: "/app"}},
+	}
+	rules := []*ProxyHandle{}
+	for _, f := range filters {
+		rules = append(rules, NewProxyHandle(&Rule{Filters: f}, nil, NewProxyLogger(), NewProxyLogger(), NewProxyLogger()))
+	}
+	index := NewProxyRuleIndex(rules)
+	cases := map[string][]int{
+		"/api/users":   {0, 1, 2, 3, 4, 5},
+		"/api/users/1": {0, 2, 3, 4, 5},
+		"/api":         {0, 3, 4, 5, 6},
+		"/apix/1":      {0, 2, 3, 4, 5},
+		"/app":         {3, 4, 5, 7},
+		"/ap":          {3, 4, 5},
+		"/":            {3, 4, 5},
+		"":             {3, 5},
+	}
+	for path, expect := range cases {
+		if got := index.candidates(path); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q: expect %v, got %v", path, expect, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ProxyReturn 由代理直接返回的响应，如重定向、固定内容或维护页面
+type ProxyReturn struct {
+	status   int
+	location *VariableExpr
+	headers  map[string]*VariableExpr
+	body     *VariableExpr
+}
+
+func NewProxyReturn(ret *Return) *ProxyReturn {
+	this := &ProxyReturn{
+		status:  ret.Status,
+		headers: map[string]*VariableExpr{},
+		body:    NewVariableExpr(ret.Body),
+	}
+	if ret.Location != "" {
+		this.location = NewVariableExpr(ret.Location)
+	}
+	for k, v := range ret.Headers {
+		this.headers[k] = NewVariableExpr(v)
+	}
+	return this
+}
+
+// serve 生成响应并写回客户端
+// 请求和响应同样会经过rule中配置的transform
+func (this *ProxyReturn) serve(handle *ProxyHandle, c *Context) {
+	handle.transformRequest(c.req, c)
+
+	resp := &http.Response{
+		StatusCode: this.status,
+		Header:     http.Header{},
+		Request:    c.req,
+	}
+	for k, v := range this.headers {
+		resp.Header.Set(k, v.Load(c.variables))
+	}
+	if this.location != nil {
+		resp.Header.Set("Location", this.location.Load(c.variables))
+	}
+	body := this.body.Load(c.variables)
+	if body != "" && resp.Header.Get("Content-Type") == "" {
+		resp.Header.Set("Content-Type", "text/plain;charset=UTF-8")
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	c.variables.Set("status", fmt.Sprintf("%d", resp.StatusCode))
+	handle.transformResponse(resp, c)
+	if b, err := ioutil.ReadAll(resp.Body); err == nil {
+		body = string(b)
+	}
+	debug("return response", resp.StatusCode, resp.Header)
+
+	header := c.w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	c.w.WriteHeader(resp.StatusCode)
+	if body != "" && c.req.Method != http.MethodHead {
+		c.w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ProxyRewrite 修改发送给目标地址的path和query
+// 执行顺序为：strip_prefix、regex、add_prefix、query
+type ProxyRewrite struct {
+	stripPrefix string
+	addPrefix   string
+	regexps     []*ProxyRewriteRegexp
+	queries     []*ProxyRewriteQuery
+}
+
+type ProxyRewriteRegexp struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+type ProxyRewriteQuery struct {
+	method string
+	key    string
+	value  *VariableExpr
+	to     string
+}
+
+func NewProxyRewrite(rewrite *Rewrite) *ProxyRewrite {
+	ret := &ProxyRewrite{
+		stripPrefix: rewrite.StripPrefix,
+		addPrefix:   rewrite.AddPrefix,
+		regexps:     []*ProxyRewriteRegexp{},
+		queries:     []*ProxyRewriteQuery{},
+	}
+	for _, r := range rewrite.Regex {
+		ret.regexps = append(ret.regexps, &ProxyRewriteRegexp{
+			re:      regexp.MustCompile(r.Pattern),
+			replace: r.Replace,
+		})
+	}
+	for _, q := range rewrite.Query {
+		ret.queries = append(ret.queries, &ProxyRewriteQuery{
+			method: q.Method,
+			key:    q.Key,
+			value:  NewVariableExpr(q.Value),
+			to:     q.To,
+		})
+	}
+	return ret
+}
+
+func (this *ProxyRewrite) apply(u *url.URL, variables *ProxyVariable) {
+	p := u.Path
+	// 只在path等于前缀或前缀后为`/`时去掉前缀，如：`/api`不会修改`/apiv2/x`
+	if this.stripPrefix != "" && isSubPath(this.stripPrefix, p) {
+		p = p[len(this.stripPrefix):]
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	for _, r := range this.regexps {
+		p = r.re.ReplaceAllString(p, r.replace)
+	}
+	if this.addPrefix != "" {
+		p = strings.TrimSuffix(this.addPrefix, "/") + p
+	}
+	if p != u.Path {
+		debug("rewrite path", u.Path, p)
+		u.Path = p
+		u.RawPath = ""
+	}
+
+	if len(this.queries) == 0 {
+		return
+	}
+	query := u.Query()
+	for _, q := range this.queries {
+		switch q.method {
+		case "set":
+			query.Set(q.key, q.value.Load(variables))
+		case "add":
+			query.Add(q.key, q.value.Load(variables))
+		case "del":
+			query.Del(q.key)
+		case "rename":
+			if values, exist := query[q.key]; exist {
+				query.Del(q.key)
+				query[q.to] = append(query[q.to], values...)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	debug("rewrite query", u.RawQuery)
+}
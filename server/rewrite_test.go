@@ -0,0 +1,30 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRewriteStripPrefix(t *testing.T) {
+	cases := []struct {
+		prefix string
+		path   string
+		expect string
+	}{
+		{"/api", "/api/x", "/x"},
+		{"/api", "/api", "/"},
+		{"/api", "/apiv2/x", "/apiv2/x"},
+		{"/api", "/v1/api/x", "/v1/api/x"},
+		{"/api/", "/api/x", "/x"},
+		{"/api/", "/apiv2/x", "/apiv2/x"},
+		{"/api/v1", "/api/v1/users", "/users"},
+		{"/api/v1", "/api/v10/users", "/api/v10/users"},
+	}
+	for _, tc := range cases {
+		u := &url.URL{Path: tc.path}
+		NewProxyRewrite(&Rewrite{StripPrefix: tc.prefix}).apply(u, NewProxyVariable())
+		if u.Path != tc.expect {
+			t.Errorf("strip %s from %s: expect %s, got %s", tc.prefix, tc.path, tc.expect, u.Path)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProxyStatic 以`file://`开头的代理目标，直接从磁盘读取文件返回
+type ProxyStatic struct {
+	index     []string
+	autoindex bool
+	tryFiles  []*VariableExpr
+}
+
+func NewProxyStatic(static *Static) *ProxyStatic {
+	ret := &ProxyStatic{
+		index:    []string{"index.html"},
+		tryFiles: []*VariableExpr{},
+	}
+	if static == nil {
+		return ret
+	}
+	if len(static.Index) > 0 {
+		ret.index = static.Index
+	}
+	ret.autoindex = static.Autoindex
+	for _, f := range static.TryFiles {
+		ret.tryFiles = append(ret.tryFiles, NewVariableExpr(f))
+	}
+	return ret
+}
+
+// staticRoot 计算`file://`目标的根目录，即第一个变量之前的目录部分
+// 如：`file:///var/www/$1`的根目录为`/var/www`，请求的文件不能超出该目录
+func staticRoot(to string) string {
+	if !strings.HasPrefix(to, "file://") {
+		return ""
+	}
+	root := strings.TrimPrefix(to, "file://")
+	if i := strings.Index(root, "$"); i >= 0 {
+		root = root[:i]
+		if !strings.HasSuffix(root, "/") {
+			root = path.Dir(root)
+		}
+	}
+	if root == "" {
+		return "/"
+	}
+	return path.Clean(root)
+}
+
+func (this *ProxyStatic) serve(c *Context) {
+	defer func() {
+		c.variables.Set("status", fmt.Sprintf("%d", c.w.status))
+	}()
+	if c.req.Method != http.MethodGet && c.req.Method != http.MethodHead {
+		c.w.Header().Set("Allow", "GET, HEAD")
+		http.Error(c.w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	root := c.target.root
+	u, err := url.Parse(c.url)
+	if err != nil {
+		c.variables.Set("error_message", fmt.Sprintf("invalid file target %v", err))
+		http.Error(c.w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	name, ok := this.resolve(root, u.Path)
+	if !ok {
+		c.variables.Set("error_message", "file path out of root "+u.Path)
+		http.Error(c.w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if this.serveFile(c, name, u.Path) {
+		return
+	}
+	for _, f := range this.tryFiles {
+		tryName, ok := this.resolve(root, f.Load(c.variables))
+		if !ok {
+			continue
+		}
+		if this.serveFile(c, tryName, "") {
+			return
+		}
+	}
+	http.Error(c.w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+// resolve 将文件路径限制在root目录中，防止路径穿越
+// 符号链接指向root以外的文件同样视为越界
+func (this *ProxyStatic) resolve(root, name string) (string, bool) {
+	if !strings.HasPrefix(name, root) {
+		name = path.Join(root, name)
+	}
+	name = path.Clean(name)
+	if !isSubPath(root, name) {
+		return "", false
+	}
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil || !isSubPath(realRoot, real) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// serveFile 返回文件或目录，文件不存在时返回false
+// urlPath不为空时，目录请求会使用index文件或目录列表
+func (this *ProxyStatic) serveFile(c *Context, name, urlPath string) bool {
+	info, err := os.Stat(name)
+	if err != nil {
+		debug("static file not found", name)
+		return false
+	}
+	if info.IsDir() {
+		if urlPath == "" {
+			return false
+		}
+		for _, index := range this.index {
+			if indexInfo, err := os.Stat(filepath.Join(name, index)); err == nil && !indexInfo.IsDir() {
+				return this.serveFile(c, filepath.Join(name, index), "")
+			}
+		}
+		if !this.autoindex {
+			return false
+		}
+		this.serveDir(c, name)
+		return true
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		debug("static file open failed", name, err)
+		return false
+	}
+	defer f.Close()
+	debug("static file", name)
+	c.w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size()))
+	http.ServeContent(c.w, c.req, info.Name(), info.ModTime(), f)
+	return true
+}
+
+func (this *ProxyStatic) serveDir(c *Context, name string) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		http.Error(c.w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	c.w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	c.w.WriteHeader(http.StatusOK)
+	if c.req.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(c.w, "<html><head><title>Index of %s</title></head><body><pre>\n", html.EscapeString(c.req.URL.Path))
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		link := url.URL{Path: entryName}
+		fmt.Fprintf(c.w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(entryName))
+	}
+	fmt.Fprintf(c.w, "</pre></body></html>\n")
+}
+
+func isSubPath(root, name string) bool {
+	return name == root || strings.HasPrefix(name, strings.TrimSuffix(root, "/")+"/")
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticResolve(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "www/sub"), 0755)
+	os.MkdirAll(filepath.Join(dir, "wwwx"), 0755)
+	os.WriteFile(filepath.Join(dir, "www/index.html"), []byte("index"), 0644)
+	os.WriteFile(filepath.Join(dir, "www/sub/a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, "wwwx/b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(dir, "secret"), filepath.Join(dir, "www/link"))
+	os.Symlink(filepath.Join(dir, "www/sub/a.txt"), filepath.Join(dir, "www/inner"))
+
+	cases := []struct {
+		path     string
+		tryFiles []string
+		status   int
+		body     string
+	}{
+		{"sub/a.txt", nil, 200, "a"},
+		{"inner", nil, 200, "a"},
+		{"", nil, 200, "index"},
+		{"../secret", nil, 403, ""},
+		{"%2e%2e/secret", nil, 403, ""},
+		{"%2E%2E/secret", nil, 403, ""},
+		{"sub/%2e%2e/%2e%2e/secret", nil, 403, ""},
+		{"..%2fsecret", nil, 403, ""},
+		{"../wwwx/b.txt", nil, 403, ""},
+		{"link", nil, 403, ""},
+		{"nope", nil, 404, ""},
+		{"nope", []string{"/index.html"}, 200, "index"},
+		{"nope", []string{"/../secret", "/link", "/sub/a.txt"}, 200, "a"},
+		{"nope", []string{"/../secret", "/link"}, 404, ""},
+		{"nope", []string{"/sub/$1"}, 404, ""},
+		{"a.txt", []string{"/sub/$1"}, 200, "a"},
+		{"secret", []string{"/../$1"}, 404, ""},
+	}
+	for _, tc := range cases {
+		rule := &Rule{To: RuleTo{{To: "file://" + dir + "/www/$1"}}, Static: &Static{TryFiles: tc.tryFiles}}
+		handle := NewProxyHandle(rule, NewProxyServices(nil), NewProxyLogger(), NewProxyLogger(), NewProxyLogger())
+		w := httptest.NewRecorder()
+		c := NewContext(w, httptest.NewRequest("GET", "/"+tc.path, nil))
+		c.variables.Set("1", tc.path)
+		handle.serve(c)
+		if w.Code != tc.status || (tc.body != "" && w.Body.String() != tc.body) {
+			t.Errorf("%s %v: expect %d %q, got %d %q", tc.path, tc.tryFiles, tc.status, tc.body, w.Code, w.Body.String())
+		}
+	}
+}
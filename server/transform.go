@@ -0,0 +1,413 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProxyQueryTransform 修改发送给目标地址的请求参数
+type ProxyQueryTransform struct {
+	method    string
+	key       string
+	value     *VariableExpr
+	pattern   *regexp.Regexp
+	condition *ProxyTransformCondition
+}
+
+func NewProxyQueryTransform(queryTransform *QueryTransform) *ProxyQueryTransform {
+	ret := &ProxyQueryTransform{
+		method:    queryTransform.Method,
+		key:       queryTransform.Key,
+		value:     NewVariableExpr(queryTransform.Value),
+		condition: NewProxyTransformCondition(queryTransform.Condition),
+	}
+	if queryTransform.Pattern != "" {
+		ret.pattern = regexp.MustCompile(queryTransform.Pattern)
+	}
+	return ret
+}
+
+func (this *ProxyQueryTransform) processRequest(r *http.Request, variables *ProxyVariable) {
+	if !this.condition.matchRequest(r, variables) {
+		return
+	}
+	query := r.URL.Query()
+	if !matchTransformPattern(this.pattern, query.Get(this.key), variables, "transform_arg_"+this.key) {
+		return
+	}
+	switch this.method {
+	case "add":
+		value := this.value.Load(variables)
+		debug("add query in request", this.key, value)
+		query.Add(this.key, value)
+	case "set":
+		value := this.value.Load(variables)
+		debug("set query in request", this.key, value)
+		query.Set(this.key, value)
+	case "del":
+		debug("del query in request", this.key)
+		query.Del(this.key)
+	}
+	r.URL.RawQuery = query.Encode()
+}
+
+// ProxyCookieTransform 修改请求中的Cookie或响应中的Set-Cookie
+// 修改响应时可以同时改写domain、path、SameSite、Secure和HttpOnly属性
+type ProxyCookieTransform struct {
+	when      string
+	method    string
+	key       string
+	value     *VariableExpr
+	hasValue  bool
+	pattern   *regexp.Regexp
+	domain    *VariableExpr
+	path      *VariableExpr
+	sameSite  http.SameSite
+	secure    *bool
+	httpOnly  *bool
+	condition *ProxyTransformCondition
+}
+
+func NewProxyCookieTransform(cookieTransform *CookieTransform) *ProxyCookieTransform {
+	ret := &ProxyCookieTransform{
+		when:     cookieTransform.When,
+		method:   cookieTransform.Method,
+		key:      cookieTransform.Key,
+		value:    NewVariableExpr(cookieTransform.Value),
+		hasValue: cookieTransform.Value != "",
+		secure:   cookieTransform.Secure,
+		httpOnly: cookieTransform.HttpOnly,
+
+		condition: NewProxyTransformCondition(cookieTransform.Condition),
+	}
+	if cookieTransform.Pattern != "" {
+		ret.pattern = regexp.MustCompile(cookieTransform.Pattern)
+	}
+	if cookieTransform.Domain != "" {
+		ret.domain = NewVariableExpr(cookieTransform.Domain)
+	}
+	if cookieTransform.Path != "" {
+		ret.path = NewVariableExpr(cookieTransform.Path)
+	}
+	switch strings.ToLower(cookieTransform.SameSite) {
+	case "lax":
+		ret.sameSite = http.SameSiteLaxMode
+	case "strict":
+		ret.sameSite = http.SameSiteStrictMode
+	case "none":
+		ret.sameSite = http.SameSiteNoneMode
+	}
+	return ret
+}
+
+// processRequest 修改请求的Cookie header
+// 只修改key对应的项，其他项保持原样
+func (this *ProxyCookieTransform) processRequest(r *http.Request, variables *ProxyVariable) {
+	if !this.condition.matchRequest(r, variables) {
+		return
+	}
+	pairs := splitCookiePairs(r.Header.Values("Cookie"))
+	current := ""
+	for _, pair := range pairs {
+		if name, value := parseCookiePair(pair); name == this.key {
+			current = value
+			break
+		}
+	}
+	if !matchTransformPattern(this.pattern, current, variables, "transform_cookie_"+this.key) {
+		return
+	}
+	ret := []string{}
+	switch this.method {
+	case "add":
+		value := this.value.Load(variables)
+		debug("add cookie in request", this.key, value)
+		ret = append(pairs, (&http.Cookie{Name: this.key, Value: value}).String())
+	case "set":
+		value := this.value.Load(variables)
+		debug("set cookie in request", this.key, value)
+		replaced := false
+		for _, pair := range pairs {
+			if name, _ := parseCookiePair(pair); name != this.key {
+				ret = append(ret, pair)
+			} else if !replaced {
+				ret = append(ret, (&http.Cookie{Name: this.key, Value: value}).String())
+				replaced = true
+			}
+		}
+		if !replaced {
+			ret = append(ret, (&http.Cookie{Name: this.key, Value: value}).String())
+		}
+	case "del":
+		debug("del cookie in request", this.key)
+		for _, pair := range pairs {
+			if name, _ := parseCookiePair(pair); name != this.key {
+				ret = append(ret, pair)
+			}
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(ret) > 0 {
+		r.Header.Set("Cookie", strings.Join(ret, "; "))
+	}
+}
+
+// splitCookiePairs 按照;拆分Cookie header，保留每一项的原始内容
+func splitCookiePairs(lines []string) []string {
+	ret := []string{}
+	for _, line := range lines {
+		for _, pair := range strings.Split(line, ";") {
+			if pair = strings.TrimSpace(pair); pair != "" {
+				ret = append(ret, pair)
+			}
+		}
+	}
+	return ret
+}
+
+// parseCookiePair 解析`name=value`，value两侧的双引号会被去掉
+func parseCookiePair(pair string) (string, string) {
+	name, value := pair, ""
+	if i := strings.Index(pair, "="); i >= 0 {
+		name, value = pair[:i], pair[i+1:]
+	}
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return name, value
+}
+
+// processResponse 修改响应的Set-Cookie header
+// set时已存在的同名Cookie只修改配置了的值和属性，没有配置value时保留原值
+func (this *ProxyCookieTransform) processResponse(r *http.Response, variables *ProxyVariable) {
+	if !this.condition.matchResponse(r, variables) {
+		return
+	}
+	lines := r.Header.Values("Set-Cookie")
+	current := ""
+	for _, line := range lines {
+		if cookie := parseSetCookie(line); cookie != nil && cookie.Name == this.key {
+			current = cookie.Value
+			break
+		}
+	}
+	if !matchTransformPattern(this.pattern, current, variables, "transform_cookie_"+this.key) {
+		return
+	}
+	ret := []string{}
+	found := false
+	for _, line := range lines {
+		cookie := parseSetCookie(line)
+		if cookie == nil || cookie.Name != this.key {
+			ret = append(ret, line)
+			continue
+		}
+		switch this.method {
+		case "add":
+			ret = append(ret, line)
+		case "set":
+			found = true
+			line = this.rewriteSetCookie(line, variables)
+			debug("set cookie in response", line)
+			ret = append(ret, line)
+		case "del":
+			debug("del cookie in response", this.key)
+		}
+	}
+	if this.method == "add" || (this.method == "set" && !found) {
+		cookie := &http.Cookie{Name: this.key}
+		this.rewrite(cookie, variables)
+		debug(fmt.Sprintf("%s cookie in response", this.method), cookie)
+		ret = append(ret, cookie.String())
+	}
+	r.Header.Del("Set-Cookie")
+	for _, line := range ret {
+		r.Header.Add("Set-Cookie", line)
+	}
+}
+
+func (this *ProxyCookieTransform) rewrite(cookie *http.Cookie, variables *ProxyVariable) {
+	if this.hasValue {
+		cookie.Value = this.value.Load(variables)
+	}
+	if this.domain != nil {
+		cookie.Domain = this.domain.Load(variables)
+	}
+	if this.path != nil {
+		cookie.Path = this.path.Load(variables)
+	}
+	if this.sameSite != 0 {
+		cookie.SameSite = this.sameSite
+	}
+	if this.secure != nil {
+		cookie.Secure = *this.secure
+	}
+	if this.httpOnly != nil {
+		cookie.HttpOnly = *this.httpOnly
+	}
+}
+
+// rewriteSetCookie 只修改Set-Cookie中配置了的值和属性，其他属性保持原样
+func (this *ProxyCookieTransform) rewriteSetCookie(line string, variables *ProxyVariable) string {
+	parts := strings.Split(line, ";")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if this.hasValue {
+		parts[0] = (&http.Cookie{Name: this.key, Value: this.value.Load(variables)}).String()
+	}
+	if this.domain != nil {
+		domain := strings.TrimPrefix(this.domain.Load(variables), ".")
+		parts = setCookieAttribute(parts, "Domain", domain, domain != "")
+	}
+	if this.path != nil {
+		path := this.path.Load(variables)
+		parts = setCookieAttribute(parts, "Path", path, path != "")
+	}
+	switch this.sameSite {
+	case http.SameSiteLaxMode:
+		parts = setCookieAttribute(parts, "SameSite", "Lax", true)
+	case http.SameSiteStrictMode:
+		parts = setCookieAttribute(parts, "SameSite", "Strict", true)
+	case http.SameSiteNoneMode:
+		parts = setCookieAttribute(parts, "SameSite", "None", true)
+	}
+	if this.secure != nil {
+		parts = setCookieAttribute(parts, "Secure", "", *this.secure)
+	}
+	if this.httpOnly != nil {
+		parts = setCookieAttribute(parts, "HttpOnly", "", *this.httpOnly)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// setCookieAttribute 删除已有的同名属性，enable为true时在末尾添加新的属性
+// value为空时只添加属性名，如Secure
+func setCookieAttribute(parts []string, name, value string, enable bool) []string {
+	ret := parts[:1]
+	for _, part := range parts[1:] {
+		if attr, _ := parseCookiePair(part); !strings.EqualFold(attr, name) {
+			ret = append(ret, part)
+		}
+	}
+	if !enable {
+		return ret
+	}
+	if value == "" {
+		return append(ret, name)
+	}
+	return append(ret, name+"="+value)
+}
+
+func parseSetCookie(line string) *http.Cookie {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {line}}}).Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	return cookies[0]
+}
+
+// matchTransformPattern 配置了pattern且值不为空时，值必须匹配pattern才继续执行
+// 匹配到的分组写入变量$n和$<namespace>_n
+func matchTransformPattern(pattern *regexp.Regexp, value string, variables *ProxyVariable, namespace string) bool {
+	if pattern == nil || value == "" {
+		return true
+	}
+	g := pattern.FindStringSubmatch(value)
+	debug(fmt.Sprintf("match %s(%v) %s->%s", namespace, g != nil, pattern, value))
+	if g == nil {
+		return false
+	}
+	setSubmatchVariables(variables, pattern, g, namespace)
+	return true
+}
+
+// ProxyTransformCondition transform的执行条件，为nil时总是执行
+// status仅对response有效，content_types在request时检查请求的Content-Type
+type ProxyTransformCondition struct {
+	statuses     [][2]int
+	contentTypes []string
+	expr         *MatchExpr
+}
+
+func NewProxyTransformCondition(condition *TransformCondition) *ProxyTransformCondition {
+	if condition == nil {
+		return nil
+	}
+	ret := &ProxyTransformCondition{
+		statuses:     [][2]int{},
+		contentTypes: condition.ContentTypes,
+	}
+	for _, status := range condition.Status {
+		if statuses, err := parseStatusRange(status); err == nil {
+			ret.statuses = append(ret.statuses, statuses)
+		}
+	}
+	if condition.Match != "" {
+		if expr, err := NewMatchExpr(condition.Match); err == nil {
+			ret.expr = expr
+		}
+	}
+	return ret
+}
+
+// parseStatusRange 解析`500`、`500-599`、`5xx`形式的状态码范围
+// `5xx`不能与范围一起使用，范围的最小值不能大于最大值
+func parseStatusRange(status string) ([2]int, error) {
+	ret := [2]int{}
+	if len(status) == 3 && status[1:] == "xx" && status[0] >= '1' && status[0] <= '5' {
+		n := int(status[0] - '0')
+		return [2]int{n * 100, n*100 + 99}, nil
+	}
+	parts := strings.SplitN(status, "-", 2)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || len(part) != 3 || n < 100 || n > 599 {
+			return ret, fmt.Errorf("invalid status %s", status)
+		}
+		ret[i] = n
+	}
+	if len(parts) == 1 {
+		ret[1] = ret[0]
+	}
+	if ret[0] > ret[1] {
+		return ret, fmt.Errorf("invalid status range %s", status)
+	}
+	return ret, nil
+}
+
+func (this *ProxyTransformCondition) matchRequest(r *http.Request, variables *ProxyVariable) bool {
+	if this == nil {
+		return true
+	}
+	if len(this.contentTypes) > 0 && !matchMediaType(this.contentTypes, r.Header.Get("Content-Type")) {
+		return false
+	}
+	return this.expr == nil || this.expr.eval(variables)
+}
+
+func (this *ProxyTransformCondition) matchResponse(r *http.Response, variables *ProxyVariable) bool {
+	if this == nil {
+		return true
+	}
+	if len(this.statuses) > 0 {
+		match := false
+		for _, status := range this.statuses {
+			if r.StatusCode >= status[0] && r.StatusCode <= status[1] {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(this.contentTypes) > 0 && !matchMediaType(this.contentTypes, r.Header.Get("Content-Type")) {
+		return false
+	}
+	return this.expr == nil || this.expr.eval(variables)
+}
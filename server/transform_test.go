@@ -0,0 +1,121 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCookieTransformRequest(t *testing.T) {
+	header := `x={"k":"v"}; b=hello world; c="q"; d=ok`
+	cases := []struct {
+		method string
+		key    string
+		value  string
+		expect string
+	}{
+		{"set", "a", "1", `x={"k":"v"}; b=hello world; c="q"; d=ok; a=1`},
+		{"set", "c", "2", `x={"k":"v"}; b=hello world; c=2; d=ok`},
+		{"add", "d", "3", `x={"k":"v"}; b=hello world; c="q"; d=ok; d=3`},
+		{"del", "b", "", `x={"k":"v"}; c="q"; d=ok`},
+		{"del", "x", "", `b=hello world; c="q"; d=ok`},
+	}
+	for _, tc := range cases {
+		transform := NewProxyCookieTransform(&CookieTransform{When: "request", Method: tc.method, Key: tc.key, Value: tc.value})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", header)
+		transform.processRequest(req, NewProxyVariable())
+		if got := req.Header.Get("Cookie"); got != tc.expect {
+			t.Errorf("%s %s: expect %q, got %q", tc.method, tc.key, tc.expect, got)
+		}
+	}
+}
+
+func TestCookieTransformResponse(t *testing.T) {
+	secure := true
+	httpOnly := false
+	lines := []string{
+		"a=1; Path=/; Partitioned; Secure; HttpOnly",
+		`b="x y"; Priority=High`,
+	}
+	cases := []struct {
+		transform *CookieTransform
+		expect    []string
+	}{
+		{
+			&CookieTransform{Method: "set", Key: "a", Value: "2"},
+			[]string{"a=2; Path=/; Partitioned; Secure; HttpOnly", lines[1]},
+		},
+		{
+			&CookieTransform{Method: "set", Key: "a", Path: "/app", SameSite: "lax", HttpOnly: &httpOnly},
+			[]string{"a=1; Partitioned; Secure; Path=/app; SameSite=Lax", lines[1]},
+		},
+		{
+			&CookieTransform{Method: "set", Key: "b", Domain: ".example.com", Secure: &secure},
+			[]string{lines[0], `b="x y"; Priority=High; Domain=example.com; Secure`},
+		},
+		{
+			&CookieTransform{Method: "set", Key: "c", Value: "3"},
+			[]string{lines[0], lines[1], "c=3"},
+		},
+		{
+			&CookieTransform{Method: "del", Key: "a"},
+			[]string{lines[1]},
+		},
+	}
+	for i, tc := range cases {
+		tc.transform.When = "response"
+		transform := NewProxyCookieTransform(tc.transform)
+		resp := &http.Response{StatusCode: 200, Header: http.Header{"Set-Cookie": append([]string{}, lines...)}}
+		transform.processResponse(resp, NewProxyVariable())
+		if got := resp.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("case %d: expect %q, got %q", i, tc.expect, got)
+		}
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	cases := []struct {
+		status string
+		expect [2]int
+		err    bool
+	}{
+		{"500", [2]int{500, 500}, false},
+		{"500-599", [2]int{500, 599}, false},
+		{"404-404", [2]int{404, 404}, false},
+		{"5xx", [2]int{500, 599}, false},
+		{"1xx", [2]int{100, 199}, false},
+		{"5xx-599", [2]int{}, true},
+		{"500-5xx", [2]int{}, true},
+		{"599-500", [2]int{}, true},
+		{"6xx", [2]int{}, true},
+		{"600", [2]int{}, true},
+		{"50", [2]int{}, true},
+		{"+50", [2]int{}, true},
+		{"500-", [2]int{}, true},
+		{"-500", [2]int{}, true},
+		{"", [2]int{}, true},
+	}
+	for _, tc := range cases {
+		got, err := parseStatusRange(tc.status)
+		if (err != nil) != tc.err || (!tc.err && got != tc.expect) {
+			t.Errorf("%q: expect %v err=%v, got %v %v", tc.status, tc.expect, tc.err, got, err)
+		}
+	}
+}
+
+func TestTransformConditionStatusValid(t *testing.T) {
+	cases := map[string]bool{
+		`{"status":["500-599","404"]}`: true,
+		`{"status":["5xx"]}`:           true,
+		`{"status":["5xx-599"]}`:       false,
+		`{"status":["599-500"]}`:       false,
+	}
+	for raw, expect := range cases {
+		err := validJson("", "condition", reflect.TypeOf(&TransformCondition{}), []byte(raw), "")
+		if (err == nil) != expect {
+			t.Errorf("%s: expect valid=%v, got %v", raw, expect, err)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -13,12 +15,25 @@ import (
 
 type ValidFunc func(raw []byte) bool
 
+// rawNormalizer 支持多种json格式的类型，在校验前将数据转换为统一的格式
+type rawNormalizer interface {
+	normalizeRaw(raw []byte) []byte
+}
+
 var (
 	funcMap map[string]ValidFunc
 )
 
 func init() {
 	funcMap = make(map[string]ValidFunc)
+	funcMap["domain"] = validDomain
+	funcMap["regexp"] = validRegexp
+	funcMap["capture"] = validCapture
+	funcMap["cidr"] = validCIDR
+	funcMap["variable"] = validVariable
+	funcMap["expression"] = validExpression
+	funcMap["origin"] = validOrigin
+	funcMap["status"] = validStatus
 }
 
 func validJson(parent string, fieldName string, fieldType reflect.Type, raw []byte, rule string) error {
@@ -26,6 +41,9 @@ func validJson(parent string, fieldName string, fieldType reflect.Type, raw []by
 	if parent != "" {
 		displayName = fmt.Sprintf("%s.%s", parent, fieldName)
 	}
+	if n, ok := reflect.Zero(fieldType).Interface().(rawNormalizer); ok && raw != nil {
+		raw = n.normalizeRaw(raw)
+	}
 	vr := newValidRule(displayName, fieldType, rule, raw)
 
 	if raw == nil {
@@ -129,6 +147,7 @@ func newValidRule(displayName string, fieldType reflect.Type, raw string, value
 		_MESSAGE_MODE,
 		_REG_MODE,
 		_RANGE_MODE,
+		_ENUM_MODE,
 		_FUNC_MODE,
 	} {
 		if m := regexp.MustCompile("("+mode+")").FindAllStringSubmatch(raw, -1); m != nil && len(m) > 0 {
@@ -229,8 +248,9 @@ func (this *enumRule) test(raw []byte) bool {
 	if val > 2 && str[0] == '"' && str[val-1] == '"' {
 		str = str[1 : val-1]
 	}
+	// 区分大小写，运行时按原值比较
 	for _, e := range this.enum {
-		if strings.EqualFold(e, str) {
+		if e == str {
 			return true
 		}
 	}
@@ -341,3 +361,100 @@ func (this *funcRule) test(raw []byte) bool {
 		return f(raw)
 	}
 }
+
+// validVariable 校验变量表达式中的修饰符
+func validVariable(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	_, err := parseVariableExpr(str)
+	return err == nil
+}
+
+// validExpression 校验match表达式能否编译
+func validExpression(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	_, err := NewMatchExpr(str)
+	return err == nil
+}
+
+// validStatus 校验transform condition中的状态码或状态码范围
+func validStatus(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	_, err := parseStatusRange(str)
+	return err == nil
+}
+
+// validOrigin 校验cors中的origin，可以是`*`、`~regexp`或`scheme://host[:port]`
+func validOrigin(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	switch {
+	case str == "*":
+		return true
+	case strings.HasPrefix(str, "~"):
+		_, err := regexp.Compile(str[1:])
+		return err == nil
+	}
+	u, err := url.Parse(str)
+	return err == nil && u.Scheme != "" && u.Host != "" && u.Path == "" && u.RawQuery == ""
+}
+
+// validCapture 校验分组会写入变量的正则表达式，命名分组不能与内置变量重名
+func validCapture(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	re, err := regexp.Compile(str)
+	return err == nil && reservedCaptureName(re) == ""
+}
+
+// validRegexp 校验正则表达式能否编译
+func validRegexp(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	_, err := regexp.Compile(str)
+	return err == nil
+}
+
+// validCIDR 校验CIDR或ip
+func validCIDR(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	if net.ParseIP(str) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(str)
+	return err == nil
+}
+
+// validDomain 校验域名，支持精确域名、通配符(*.example.com)和正则(~regexp)
+func validDomain(raw []byte) bool {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(str, "~"):
+		re, err := regexp.Compile(str[1:])
+		return len(str) > 1 && err == nil && reservedCaptureName(re) == ""
+	case strings.HasPrefix(str, "*."):
+		return regexp.MustCompile(`^[a-z0-9-_\.]+$`).MatchString(str[2:])
+	default:
+		return regexp.MustCompile(`^[a-z0-9-_\.]+$`).MatchString(str)
+	}
+}
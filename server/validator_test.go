@@ -0,0 +1,22 @@
+package service
+
+import "testing"
+
+func TestEnumRuleCaseSensitive(t *testing.T) {
+	rule := newEnumRule("add,set,del")
+	cases := []struct {
+		raw    string
+		expect bool
+	}{
+		{`"del"`, true},
+		{`"set"`, true},
+		{`"DEL"`, false},
+		{`"Set"`, false},
+		{`"get"`, false},
+	}
+	for _, tc := range cases {
+		if rule.test([]byte(tc.raw)) != tc.expect {
+			t.Errorf("enum test %s expect %v", tc.raw, tc.expect)
+		}
+	}
+}
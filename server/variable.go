@@ -1,28 +1,280 @@
 package service
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 )
 
+// VariableExpr 变量表达式，在创建时解析为token列表，求值时只需遍历一次
+// 支持`$name`、`${name}`两种写法，`$$`表示字符`$`
+// `${name|modifier:arg|...}`写法可以对变量值依次使用修饰符，如：`${header_User-Agent|lower}`
+// 不存在的变量保持原样输出
 type VariableExpr struct {
-	expr string
+	expr   string
+	tokens []*variableToken
+}
+
+type variableToken struct {
+	// text 为常量文本，或变量的原始写法
+	text string
+	// ref 为引用的变量，为nil时表示常量
+	ref *variableRef
+	// cuts 为不带括号的变量名中`-`的位置(从后往前)
+	// 变量不存在时依次尝试`-`之前的部分，如：`$host-foo`在没有变量host-foo时输出`$host`和`-foo`
+	cuts []int
 }
 
 func NewVariableExpr(expr string) *VariableExpr {
-	return &VariableExpr{expr: expr}
+	ret, err := parseVariableExpr(expr)
+	if err != nil {
+		debug("invalid variable expression", expr, err)
+	}
+	return ret
+}
+
+// parseVariableExpr 解析变量表达式，不合法的变量按常量处理，并返回第一个错误
+func parseVariableExpr(expr string) (*VariableExpr, error) {
+	ret := &VariableExpr{expr: expr, tokens: []*variableToken{}}
+	var firstErr error
+	var sb strings.Builder
+	for i := 0; i < len(expr); {
+		if expr[i] != '$' {
+			sb.WriteByte(expr[i])
+			i++
+			continue
+		}
+		if strings.HasPrefix(expr[i:], "$$") {
+			sb.WriteByte('$')
+			i += 2
+			continue
+		}
+		name, n := scanVariableName(expr[i:])
+		if name == "" {
+			sb.WriteByte('$')
+			i++
+			continue
+		}
+		ref, err := parseVariableRef(name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			sb.WriteString(expr[i : i+n])
+			i += n
+			continue
+		}
+		if sb.Len() > 0 {
+			ret.tokens = append(ret.tokens, &variableToken{text: sb.String()})
+			sb.Reset()
+		}
+		token := &variableToken{text: expr[i : i+n], ref: ref}
+		if expr[i+1] != '{' {
+			for j := len(name) - 1; j > 0; j-- {
+				if name[j] == '-' {
+					token.cuts = append(token.cuts, j)
+				}
+			}
+		}
+		ret.tokens = append(ret.tokens, token)
+		i += n
+	}
+	if sb.Len() > 0 {
+		ret.tokens = append(ret.tokens, &variableToken{text: sb.String()})
+	}
+	return ret, firstErr
 }
 
 func (this *VariableExpr) Load(params *ProxyVariable) string {
+	ret, _ := this.load(params)
+	return ret
+}
+
+// load 求值，同时返回表达式中的变量是否都存在
+func (this *VariableExpr) load(params *ProxyVariable) (string, bool) {
 	params.mux.RLock()
 	defer params.mux.RUnlock()
-	ret := this.expr
-	for k, v := range params.data {
-		ret = strings.Replace(ret, fmt.Sprintf("$%s", k), v, -1)
+	resolved := true
+	var sb strings.Builder
+	for _, token := range this.tokens {
+		if token.ref == nil {
+			sb.WriteString(token.text)
+			continue
+		}
+		if value, exist := token.ref.value(params.data); exist {
+			sb.WriteString(value)
+		} else if value, rest, exist := token.loadPrefix(params.data); exist {
+			sb.WriteString(value)
+			sb.WriteString(rest)
+		} else {
+			resolved = false
+			sb.WriteString(token.text)
+		}
 	}
-	debug(fmt.Sprintf("load variables '%s'->'%s' with \n%s", this.expr, ret, stringify(params.data)))
-	return ret
+	ret := sb.String()
+	if debugEnable {
+		debug(fmt.Sprintf("load variables '%s'->'%s' with \n%s", this.expr, ret, stringify(params.data)))
+	}
+	return ret, resolved
+}
+
+// loadPrefix 查找变量名中`-`之前最长的已存在的变量，返回变量值和剩余的常量文本
+func (this *variableToken) loadPrefix(data map[string]string) (string, string, bool) {
+	for _, cut := range this.cuts {
+		if value, exist := data[this.ref.name[:cut]]; exist {
+			// text为不带括号的原始写法`$name`
+			return value, this.text[1+cut:], true
+		}
+	}
+	return "", "", false
+}
+
+// variableRef 变量引用，由变量名和修饰符组成，如：`cookie_session|default:anon`
+type variableRef struct {
+	name      string
+	modifiers []*variableModifier
+}
+
+type variableModifier struct {
+	name string
+	arg  string
+	n    int
+}
+
+func parseVariableRef(src string) (*variableRef, error) {
+	parts := strings.Split(src, "|")
+	ret := &variableRef{name: parts[0], modifiers: []*variableModifier{}}
+	if ret.name == "" {
+		return nil, fmt.Errorf("empty variable name in %s", src)
+	}
+	ret.name = canonicalHeaderVariable(ret.name)
+	for _, part := range parts[1:] {
+		m := &variableModifier{name: part}
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			m.name = part[:i]
+			m.arg = part[i+1:]
+		}
+		switch m.name {
+		case "lower", "upper", "urlencode":
+			if m.arg != "" {
+				return nil, fmt.Errorf("modifier %s has no argument", m.name)
+			}
+		case "default":
+		case "hash":
+			if m.arg != "md5" && m.arg != "sha1" && m.arg != "sha256" {
+				return nil, fmt.Errorf("unsupported hash %s", m.arg)
+			}
+		case "truncate":
+			n, err := strconv.Atoi(m.arg)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid truncate length %s", m.arg)
+			}
+			m.n = n
+		default:
+			return nil, fmt.Errorf("unknown modifier %s", m.name)
+		}
+		ret.modifiers = append(ret.modifiers, m)
+	}
+	return ret, nil
+}
+
+// canonicalHeaderVariable 包含header名的变量使用规范的header名保存
+// 如：`$header_user-agent`等同于`$header_User-Agent`，`$hdr_x-canary_1`等同于`$hdr_X-Canary_1`
+func canonicalHeaderVariable(name string) string {
+	if strings.HasPrefix(name, "header_") {
+		return "header_" + http.CanonicalHeaderKey(name[len("header_"):])
+	}
+	for _, prefix := range []string{"hdr_", "transform_hdr_"} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// 最后一个`_`之后为分组序号
+		key := name[len(prefix):]
+		if i := strings.LastIndexByte(key, '_'); i > 0 {
+			return prefix + http.CanonicalHeaderKey(key[:i]) + key[i:]
+		}
+	}
+	return name
+}
+
+// value 计算变量的值，变量不存在且没有default修饰符时返回false
+func (this *variableRef) value(data map[string]string) (string, bool) {
+	ret, exist := data[this.name]
+	for _, m := range this.modifiers {
+		if m.name == "default" {
+			if ret == "" {
+				ret = m.arg
+			}
+			exist = true
+			continue
+		}
+		if !exist {
+			continue
+		}
+		switch m.name {
+		case "lower":
+			ret = strings.ToLower(ret)
+		case "upper":
+			ret = strings.ToUpper(ret)
+		case "urlencode":
+			ret = url.QueryEscape(ret)
+		case "hash":
+			ret = hashString(m.arg, ret)
+		case "truncate":
+			if r := []rune(ret); len(r) > m.n {
+				ret = string(r[:m.n])
+			}
+		}
+	}
+	return ret, exist
+}
+
+func hashString(algorithm, str string) string {
+	var h hash.Hash
+	switch algorithm {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		h = md5.New()
+	}
+	h.Write([]byte(str))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reservedVariables 内置变量，正则的命名分组不能使用这些名称
+var reservedVariables = map[string]bool{
+	"request_start": true, "request_start_msec": true, "request_start_iso8601": true, "request_end": true,
+	"request_id": true, "server_port": true, "http_version": true, "scheme": true,
+	"tls_version": true, "tls_cipher": true, "sni": true,
+	"method": true, "host": true, "uri_path": true, "uri_query": true, "request_uri": true,
+	"remote_ip": true, "client_ip": true, "x_forward_for": true, "rule_name": true,
+	"real_host": true, "upstream_uri": true, "upstream_addr": true, "upstream_status": true, "upstream_latency": true,
+	"status": true, "latency": true, "error_message": true, "bytes_received": true, "bytes_sent": true,
+}
+
+// reservedVariablePrefixes 内置变量的前缀，如：`$header_<key>`、`$uri_1`、`$transform_arg_<key>_1`
+var reservedVariablePrefixes = []string{"header_", "cookie_", "arg_", "domain_", "uri_", "hdr_", "transform_"}
+
+func isReservedVariable(name string) bool {
+	if reservedVariables[name] {
+		return true
+	}
+	for _, prefix := range reservedVariablePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 type ProxyVariable struct {
@@ -0,0 +1,88 @@
+package service
+
+import "testing"
+
+func TestVariableExprLoad(t *testing.T) {
+	variables := NewProxyVariable()
+	variables.Set("host", "a.com")
+	variables.Set("host_name", "b")
+	variables.Set("header_X-Admin", "1")
+	variables.Set("1", "one")
+	variables.Set("10", "ten")
+	variables.Set("remote_ip", "10.0.0.1")
+	variables.Set("header_User-Agent", "Mozilla/5.0")
+	cases := []struct {
+		expr     string
+		expect   string
+		resolved bool
+	}{
+		{"$host", "a.com", true},
+		{"$host_name", "b", true},
+		{"${host}_name", "a.com_name", true},
+		{"$1-$10", "one-ten", true},
+		{"$1abc", "oneabc", true},
+		{"$$host", "$host", true},
+		{"$header_X-Admin", "1", true},
+		{"$host-foo", "a.com-foo", true},
+		{"$host-foo-bar", "a.com-foo-bar", true},
+		{"$remote_ip-", "10.0.0.1-", true},
+		{"$unknown", "$unknown", false},
+		{"$unknown-foo", "$unknown-foo", false},
+		{"${unknown}", "${unknown}", false},
+		{"cost $", "cost $", true},
+		{"${header_user-agent|lower}", "mozilla/5.0", true},
+		{"$header_user-agent", "Mozilla/5.0", true},
+		{"$header_USER-AGENT-x", "Mozilla/5.0-x", true},
+	}
+	for _, tc := range cases {
+		ret, resolved := NewVariableExpr(tc.expr).load(variables)
+		if ret != tc.expect || resolved != tc.resolved {
+			t.Errorf("%s: expect %q(%v), got %q(%v)", tc.expr, tc.expect, tc.resolved, ret, resolved)
+		}
+	}
+}
+
+func TestVariableExprModifiers(t *testing.T) {
+	variables := NewProxyVariable()
+	variables.Set("ip", "10.0.0.1")
+	variables.Set("query", "a=1&b=2")
+	variables.Set("empty", "")
+	variables.Set("name", "Proxy")
+	cases := []struct {
+		expr   string
+		expect string
+	}{
+		{"${name|lower}", "proxy"},
+		{"${name|upper}", "PROXY"},
+		{"${query|urlencode}", "a%3D1%26b%3D2"},
+		{"${missing|default:anon}", "anon"},
+		{"${empty|default:anon}", "anon"},
+		{"${name|default:anon}", "Proxy"},
+		{"${ip|hash:md5}", "190dafab69706a67221c1226360de7dc"},
+		{"${name|truncate:3}", "Pro"},
+		{"${name|truncate:10}", "Proxy"},
+		{"${name|lower|truncate:2}", "pr"},
+		{"${missing|lower}", "${missing|lower}"},
+		{"${missing|default:ANON|lower}", "anon"},
+	}
+	for _, tc := range cases {
+		if got := NewVariableExpr(tc.expr).Load(variables); got != tc.expect {
+			t.Errorf("%s: expect %q, got %q", tc.expr, tc.expect, got)
+		}
+	}
+}
+
+func TestParseVariableExprError(t *testing.T) {
+	for _, expr := range []string{
+		"${a|unknown}",
+		"${a|hash:crc32}",
+		"${a|truncate:0}",
+		"${a|truncate:x}",
+		"${a|lower:x}",
+		"${|lower}",
+	} {
+		if _, err := parseVariableExpr(expr); err == nil {
+			t.Errorf("%s: expect error", expr)
+		}
+	}
+}